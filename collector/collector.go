@@ -1,7 +1,8 @@
 package collector
 
 import (
-	"strings"
+	"fmt"
+	"sync"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
@@ -33,64 +34,202 @@ func NewCounterKey(object *perflib.PerfObject, def *perflib.PerfCounterDef) Coun
 	return CounterKey{object.NameIndex, def.NameIndex, def.CounterType}
 }
 
+// Metric descriptions depend on the counter and on whether the object has
+// instances, which adds the "name" label.
+type descKey struct {
+	CounterKey
+	multiInstance bool
+	aggregate     bool
+}
+
+// Options for NewPerflibCollectorWithOptions. The zero value behaves like
+// NewPerflibCollector.
+type Options struct {
+	// How total instances (like "_Total") are handled. Defaults to TotalDrop.
+	TotalPolicy TotalPolicy
+	// Overrides TotalPolicy for individual objects, by object index
+	ObjectTotalPolicies map[uint]TotalPolicy
+
+	// Renames, labels and instance filters by object index. Objects without
+	// an entry use the built-in defaults (see defaultObjectOptions).
+	Objects map[uint]*ObjectOptions
+}
+
 type PerflibCollector struct {
+	source       perflib.Source
 	perflibQuery string
-	perflibDescs map[CounterKey]*prometheus.Desc
 	logger       log.Logger
+	options      Options
+
+	// Metric descriptions, built on demand as objects and counters show up
+	mu           sync.Mutex
+	perflibDescs map[descKey]*prometheus.Desc
 }
 
-func NewPerflibCollector(l log.Logger, query string) (c PerflibCollector) {
-	c.perflibQuery = query
-	c.logger = l
+var unsupportedCountersDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(Namespace, "exporter", "unsupported_counters"),
+	"perflib_exporter: Number of counter definitions dropped during the last scrape because their type is not supported, counted once per object rather than per instance.",
+	[]string{"counter_type"},
+	nil,
+)
+
+// Create a collector for the given query. Metric descriptions are built during
+// scrapes, so objects and counters which only show up later (like those of
+// providers installed after startup) are collected as well.
+func NewPerflibCollector(l log.Logger, source perflib.Source, query string) *PerflibCollector {
+	return NewPerflibCollectorWithOptions(l, source, query, Options{})
+}
 
-	objects, err := perflib.QueryPerformanceData(c.perflibQuery)
+func NewPerflibCollectorWithOptions(l log.Logger, source perflib.Source, query string, opts Options) *PerflibCollector {
+	return &PerflibCollector{
+		source:       source,
+		perflibQuery: query,
+		logger:       l,
+		options:      opts,
+		perflibDescs: make(map[descKey]*prometheus.Desc),
+	}
+}
 
-	if err != nil {
-		panic(err)
+// Options for an object, or nil if there are none.
+func (c *PerflibCollector) objectOptions(objectIndex uint) *ObjectOptions {
+	if o, ok := c.options.Objects[objectIndex]; ok {
+		return o
 	}
 
-	level.Debug(c.logger).Log("object_count", len(objects))
+	return defaultObjectOptions[objectIndex]
+}
 
-	c.perflibDescs = make(map[CounterKey]*prometheus.Desc)
+// Names of the labels promoted from counters of an object.
+func (c *PerflibCollector) PromotedLabels(objectIndex uint) []string {
+	return c.objectOptions(objectIndex).promotedLabelNames()
+}
 
-	for _, object := range objects {
-		for _, def := range object.CounterDefs {
-			desc := descFromCounterDef(*object, *def)
+// Values of the labels promoted from counters of an instance, in the same order
+// as PromotedLabels.
+func (c *PerflibCollector) PromotedLabelValues(objectIndex uint, instance *perflib.PerfInstance) []string {
+	return c.objectOptions(objectIndex).promotedLabelValues(instance)
+}
 
-			key := NewCounterKey(object, def)
+func (c *PerflibCollector) totalPolicy(objectIndex uint) TotalPolicy {
+	if p, ok := c.options.ObjectTotalPolicies[objectIndex]; ok {
+		return p
+	}
+
+	if c.options.TotalPolicy == "" {
+		return TotalDrop
+	}
+
+	return c.options.TotalPolicy
+}
+
+// Whether an object's metrics have a "name" label. This must not depend on the
+// current number of instances, or the label set would change whenever an
+// object has exactly one instance.
+func isMultiInstance(object *perflib.PerfObject) bool {
+	return object.HasInstances
+}
+
+// Return the metric descriptions for an object's counters, in the same order
+// as its CounterDefs. Descriptions are cached across scrapes. Aggregate
+// descriptions are used for total instances (see TotalAggregate).
+func (c *PerflibCollector) objectDescs(object *perflib.PerfObject, aggregate bool) []*prometheus.Desc {
+	multiInstance := isMultiInstance(object)
+	opts := c.objectOptions(object.NameIndex)
+	descs := make([]*prometheus.Desc, len(object.CounterDefs))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, def := range object.CounterDefs {
+		key := descKey{NewCounterKey(object, def), multiInstance, aggregate}
+		desc, ok := c.perflibDescs[key]
+
+		if !ok {
+			desc = descFromCounterDef(*object, *def, aggregate, opts)
 			c.perflibDescs[key] = desc
 		}
+
+		descs[i] = desc
 	}
 
-	return
+	return descs
 }
 
-func (c PerflibCollector) Collect(ch chan<- prometheus.Metric) (err error) {
+func (c *PerflibCollector) Collect(ch chan<- prometheus.Metric) (err error) {
 	// TODO QueryPerformanceData timing metric
-	objects, err := perflib.QueryPerformanceData(c.perflibQuery)
+	snapshot, err := c.source.Query(c.perflibQuery)
 
 	if err != nil {
-		// TODO - we shouldn't panic if a single call fails
-		panic(err)
+		return fmt.Errorf("failed to query perflib: %v", err)
 	}
 
-	level.Debug(c.logger).Log("object_count", len(objects))
+	level.Debug(c.logger).Log("object_count", len(snapshot.Objects))
+
+	// Wall clock time of the snapshot, as a unix timestamp
+	collectedAt := float64(snapshot.SystemTime.UnixNano()) / 1e9
 
-	for _, object := range objects {
+	// Definitions are shared by all instances of an object, so each one is
+	// only counted once
+	unsupported := make(map[uint32]int)
+	dropped := make(map[*perflib.PerfCounterDef]bool)
+
+	for _, object := range snapshot.Objects {
 		n := object.NameIndex
+		opts := c.objectOptions(n)
+		objectDescs := c.objectDescs(object, false)
+		multiInstance := isMultiInstance(object)
+		hasAggregate := false
 
 		for _, instance := range object.Instances {
 			name := instance.Name
+			descs := objectDescs
+			aggregate := false
 
-			// _Total metrics do not fit into the Prometheus model - we try to merge similar
-			// metrics and give them labels, so you'd sum() them instead. Having a _Total label
-			// would make
-			if strings.HasSuffix(name, "_Total") || strings.HasPrefix(name, "Total") {
+			if multiInstance && !opts.includeInstance(name) {
 				continue
 			}
 
-			for _, counter := range instance.Counters {
-				if IsDefPromotedLabel(n, counter.Def.NameIndex) {
+			if multiInstance {
+				switch c.totalPolicy(n) {
+				case TotalDrop:
+					if isTotalInstance(name) {
+						continue
+					}
+				case TotalAggregate:
+					if name != opts.totalInstance() {
+						break
+					}
+
+					// Aggregates have no instance labels, so there can only be one
+					if hasAggregate {
+						level.Debug(c.logger).Log("msg", "dropping additional total instance", "object", object.Name, "instance", name)
+						continue
+					}
+
+					descs = c.objectDescs(object, true)
+					aggregate = true
+					hasAggregate = true
+				}
+			}
+
+			// Same for all counters of the instance
+			instanceLabels := []string{name}
+
+			if !multiInstance || aggregate {
+				instanceLabels = []string{}
+			}
+
+			if !aggregate {
+				instanceLabels = append(instanceLabels, opts.promotedLabelValues(instance)...)
+			}
+
+			for i, counter := range instance.Counters {
+				if opts.isPromotedLabel(counter.Def.NameIndex) {
+					continue
+				}
+
+				// Average bases are exported along with their numerator, as the summary's count
+				if i > 0 && instance.Counters[i-1].Def.Base == counter.Def && IsAverage(instance.Counters[i-1].Def.CounterType) {
 					continue
 				}
 
@@ -114,67 +253,83 @@ func (c PerflibCollector) Collect(ch chan<- prometheus.Metric) (err error) {
 					continue
 				}
 
-				key := NewCounterKey(object, counter.Def)
+				desc := descs[i]
 
-				desc, ok := c.perflibDescs[key]
+				labels := instanceLabels
 
-				if !ok {
-					level.Debug(c.logger).Log("msg", "missing metric description for counter", "object", object.Name, "instance", instance.Name, "counter", counter.Def.Name)
-					continue
+				if merge, value := opts.mergedLabel(counter.Def.NameIndex); merge != nil {
+					labels = append(labels[:len(labels):len(labels)], value)
 				}
 
-				labels := []string{name}
-
-				if len(object.Instances) == 1 {
-					labels = []string{}
-				}
+				valueType, err := GetPrometheusValueType(counter.Def.CounterType)
 
-				if HasPromotedLabels(n) {
-					labels = append(labels, PromotedLabelValuesForInstance(n, instance)...)
+				if IsAverage(counter.Def.CounterType) && counter.Def.Base == nil {
+					err = fmt.Errorf("average counter %d has no base counter", counter.Def.NameIndex)
 				}
 
-				// TODO - Label merging needs to be fixed for [230] Process
-				//if HasMergedLabels(n) {
-				//	_, value := MergedMetricForInstance(n, counter.Def.NameIndex)
-				//
-				//	// Null string in definition means we should skip this metric (it's probably a sum)
-				//	if value == "" {
-				//		log.Debugf("Skipping %d -> %s (empty merge label)", n, counter.Def.NameIndex)
-				//		continue
-				//	}
-				//	labels = append(labels, value)
-				//}
-
-				valueType, err := GetPrometheusValueType(counter.Def.CounterType)
-
 				if err != nil {
-					// TODO - Is this too verbose? There will always be counter types we don't support
-					level.Debug(c.logger).Log("err", err)
+					if !dropped[counter.Def] {
+						level.Debug(c.logger).Log("err", err)
+						dropped[counter.Def] = true
+						unsupported[counter.Def.CounterType]++
+					}
 					continue
 				}
 
-				value := float64(counter.Value)
+				scaleType := counter.Def.CounterType
 
-				if counter.Def.IsNanosecondCounter {
-					value = value * hundredNsToSecondsScaleFactor
+				if scaleType == PERF_PRECISION_TIMESTAMP && i > 0 && instance.Counters[i-1].Def.Base == counter.Def {
+					// The timestamp shares the time base of the precision timer it belongs to
+					scaleType = instance.Counters[i-1].Def.CounterType
 				}
 
+				value := float64(counter.Value) * TimerScaleFactor(scaleType, object.Frequency, snapshot.PerfFreq)
+
 				if IsElapsedTime(counter.Def.CounterType) {
-					// convert from Windows timestamp (1 jan 1601) to unix timestamp (1 jan 1970)
-					value = float64(counter.Value-116444736000000000) / float64(object.Frequency)
+					// The counter holds a start time in the object's time base, which
+					// we export as a unix timestamp
+					value = collectedAt - object.ElapsedSeconds(counter)
 				}
 
-				metric := prometheus.MustNewConstMetric(
-					desc,
-					valueType,
-					value,
-					labels...,
-				)
+				var metric prometheus.Metric
+
+				if IsAverage(counter.Def.CounterType) {
+					// The numerator is a running total, the base counts the operations
+					metric, err = prometheus.NewConstSummary(
+						desc,
+						uint64(counter.BaseValue),
+						value,
+						nil,
+						labels...,
+					)
+				} else {
+					metric, err = prometheus.NewConstMetric(
+						desc,
+						valueType,
+						value,
+						labels...,
+					)
+				}
+
+				if err != nil {
+					// For example, the labels changed since the description was built
+					level.Debug(c.logger).Log("msg", "invalid metric", "object", object.Name, "instance", instance.Name, "counter", counter.Def.Name, "err", err)
+					continue
+				}
 
 				ch <- metric
 			}
 		}
 	}
 
+	for counterType, count := range unsupported {
+		ch <- prometheus.MustNewConstMetric(
+			unsupportedCountersDesc,
+			prometheus.GaugeValue,
+			float64(count),
+			fmt.Sprintf("%#08x", counterType),
+		)
+	}
+
 	return nil
 }
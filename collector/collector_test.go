@@ -0,0 +1,497 @@
+package collector
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/leoluk/perflib_exporter/perflib"
+	"github.com/leoluk/perflib_exporter/perflib/perflibtest"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Parse a synthetic buffer, resolving counter names from names
+func parseSnapshot(t *testing.T, b *perflibtest.Buffer, names map[uint32]string) *perflib.Snapshot {
+	snapshot, err := perflib.ParseSnapshot(b.Bytes(), perflib.NewNameTable(names), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return snapshot
+}
+
+func testSnapshot(t *testing.T) *perflib.Snapshot {
+	b := perflibtest.New()
+
+	disk := b.AddObject(236)
+	disk.AddCounter(214, PERF_COUNTER_COUNTER, 4)
+	disk.AddCounter(208, PERF_AVERAGE_TIMER, 8)
+	disk.AddCounter(209, PERF_AVERAGE_BASE, 4)
+	disk.AddCounter(198, PERF_COUNTER_RAWCOUNT, 4)
+	disk.AddCounter(300, PERF_COUNTER_HISTOGRAM_TYPE, 4)
+	disk.AddInstance("C:", 42, 20000000, 4, 3, 1)
+	disk.AddInstance("D:", 42, 20000000, 4, 3, 1)
+
+	names := map[uint32]string{
+		236: "LogicalDisk",
+		214: "Disk Reads/sec",
+		208: "Avg. Disk sec/Read",
+		209: "Avg. Disk sec/Read",
+		198: "Current Disk Queue Length",
+		300: "Histogram",
+	}
+
+	return parseSnapshot(t, b, names)
+}
+
+func collectMetrics(t *testing.T, c Collector) map[string]*dto.Metric {
+	ch := make(chan prometheus.Metric, 100)
+
+	if err := c.Collect(ch); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+
+	metrics := make(map[string]*dto.Metric)
+
+	for m := range ch {
+		pb := new(dto.Metric)
+		if err := m.Write(pb); err != nil {
+			t.Fatal(err)
+		}
+
+		key := m.Desc().String()
+		for _, l := range pb.Label {
+			if l.GetName() == "name" {
+				key = l.GetValue() + " " + key
+			}
+		}
+		metrics[key] = pb
+	}
+
+	return metrics
+}
+
+func findMetric(metrics map[string]*dto.Metric, instance, fqName string) *dto.Metric {
+	for k, m := range metrics {
+		if strings.HasPrefix(k, instance) && strings.Contains(k, `fqName: "`+fqName+`"`) {
+			return m
+		}
+	}
+	return nil
+}
+
+func TestPerflibCollector(t *testing.T) {
+	source := &perflib.FakeSource{Snapshots: map[string]*perflib.Snapshot{"236": testSnapshot(t)}}
+	c := NewPerflibCollector(log.NewNopLogger(), source, "236")
+
+	metrics := collectMetrics(t, c)
+
+	reads := findMetric(metrics, "C:", "perflib_logicaldisk_disk_reads_total")
+	if reads == nil || reads.GetCounter().GetValue() != 42 {
+		t.Errorf("unexpected disk reads %v", reads)
+	}
+
+	latency := findMetric(metrics, "D:", "perflib_logicaldisk_avg_disk_sec_per_read")
+	if latency == nil || latency.GetSummary().GetSampleCount() != 4 || latency.GetSummary().GetSampleSum() != 2 {
+		t.Errorf("unexpected read latency summary %v", latency)
+	}
+
+	queue := findMetric(metrics, "C:", "perflib_logicaldisk_current_disk_queue_length")
+	if queue == nil || queue.GetGauge().GetValue() != 3 {
+		t.Errorf("unexpected queue length %v", queue)
+	}
+
+	var unsupported *dto.Metric
+	for k, m := range metrics {
+		if strings.Contains(k, "perflib_exporter_unsupported_counters") {
+			unsupported = m
+		}
+	}
+	// The histogram is dropped for both instances, but only counted once
+	if unsupported == nil || unsupported.GetGauge().GetValue() != 1 {
+		t.Errorf("expected 1 unsupported counter, got %v", unsupported)
+	}
+
+	if q := source.Queries(); len(q) != 1 || q[0] != "236" {
+		t.Errorf("unexpected queries %v", q)
+	}
+}
+
+func TestPerflibCollectorPrecisionTimer(t *testing.T) {
+	b := perflibtest.New()
+
+	adapter := b.AddObject(5000)
+	adapter.AddCounter(5002, PERF_PRECISION_100NS_TIMER, 8)
+	adapter.AddCounter(5004, PERF_PRECISION_TIMESTAMP, 8)
+	adapter.SetValues(5000000, 20000000)
+
+	names := map[uint32]string{
+		5000: "Adapter",
+		5002: "Busy Time",
+		5004: "Busy Timestamp",
+	}
+
+	snapshot := parseSnapshot(t, b, names)
+
+	source := &perflib.FakeSource{Snapshots: map[string]*perflib.Snapshot{"": snapshot}}
+	metrics := collectMetrics(t, NewPerflibCollector(log.NewNopLogger(), source, "5000"))
+
+	if m := findMetric(metrics, "", "perflib_adapter_busy_time_total"); m == nil || m.GetCounter().GetValue() != 0.5 {
+		t.Errorf("unexpected timer %v", m)
+	}
+
+	// The timestamp is in the timer's time base (100ns)
+	if m := findMetric(metrics, "", "perflib_adapter_busy_timestamp_total"); m == nil || m.GetCounter().GetValue() != 2 {
+		t.Errorf("unexpected timestamp %v", m)
+	}
+}
+
+func TestPerflibCollectorQueryError(t *testing.T) {
+	source := &perflib.FakeSource{Err: errors.New("registry unavailable")}
+
+	// Must not panic at startup either
+	c := NewPerflibCollector(log.NewNopLogger(), source, "236")
+
+	if err := c.Collect(make(chan prometheus.Metric, 100)); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	// Descriptions are built once the source recovers
+	source.Err = nil
+	source.Snapshots = map[string]*perflib.Snapshot{"236": testSnapshot(t)}
+
+	if findMetric(collectMetrics(t, c), "C:", "perflib_logicaldisk_disk_reads_total") == nil {
+		t.Fatal("expected metrics after the source recovered")
+	}
+
+	// ...and kept when it fails again
+	n := len(c.perflibDescs)
+	source.Err = errors.New("registry unavailable")
+
+	if err := c.Collect(make(chan prometheus.Metric, 100)); err == nil {
+		t.Error("expected an error")
+	}
+	if n == 0 || len(c.perflibDescs) != n {
+		t.Error("expected the descriptions to be kept")
+	}
+}
+
+// Snapshot with a Web Service object, which has the given instances
+func webServiceSnapshot(t *testing.T, instances ...string) *perflib.Snapshot {
+	b := perflibtest.New()
+
+	web := b.AddObject(2916)
+	web.AddCounter(2918, PERF_COUNTER_LARGE_RAWCOUNT, 8)
+
+	for _, name := range instances {
+		web.AddInstance(name, 5)
+	}
+
+	if len(instances) == 0 {
+		web.SetValues(5)
+	}
+
+	names := map[uint32]string{2916: "Web Service", 2918: "Current Connections"}
+
+	return parseSnapshot(t, b, names)
+}
+
+func TestPerflibCollectorDynamicObjects(t *testing.T) {
+	source := &perflib.FakeSource{Snapshots: map[string]*perflib.Snapshot{"": testSnapshot(t)}}
+	c := NewPerflibCollector(log.NewNopLogger(), source, "Global")
+
+	collectMetrics(t, c)
+
+	// Objects which show up after startup are collected as well
+	source.Snapshots[""] = webServiceSnapshot(t, "Default Web Site", "_Total", "intranet")
+
+	if m := findMetric(collectMetrics(t, c), "intranet", "perflib_web_service_current_connections"); m == nil || m.GetGauge().GetValue() != 5 {
+		t.Errorf("expected metrics for a new object, got %v", m)
+	}
+
+	// The name label must not disappear when only one instance is left
+	source.Snapshots[""] = webServiceSnapshot(t, "intranet")
+
+	m := findMetric(collectMetrics(t, c), "intranet", "perflib_web_service_current_connections")
+	if m == nil || len(m.Label) != 1 || m.Label[0].GetName() != "name" {
+		t.Errorf("expected a name label for a single instance, got %v", m)
+	}
+
+	// Objects without instances have no name label
+	source.Snapshots[""] = webServiceSnapshot(t)
+
+	m = findMetric(collectMetrics(t, c), "", "perflib_web_service_current_connections")
+	if m == nil || len(m.Label) != 0 {
+		t.Errorf("expected no labels for an object without instances, got %v", m)
+	}
+}
+
+func TestPerflibCollectorTotalPolicy(t *testing.T) {
+	snapshot := webServiceSnapshot(t, "Default Web Site", "_Total", "TotalBackup")
+
+	for _, tc := range []struct {
+		options Options
+		// Instances exported with a name label
+		total, backup bool
+		aggregate     bool
+	}{
+		{Options{}, false, false, false},
+		{Options{TotalPolicy: TotalDrop}, false, false, false},
+		{Options{TotalPolicy: TotalKeep}, true, true, false},
+		// Only the exact total instance is aggregated
+		{Options{TotalPolicy: TotalAggregate}, false, true, true},
+		{Options{TotalPolicy: TotalKeep, ObjectTotalPolicies: map[uint]TotalPolicy{2916: TotalAggregate}}, false, true, true},
+		{Options{TotalPolicy: TotalAggregate, ObjectTotalPolicies: map[uint]TotalPolicy{236: TotalKeep}}, false, true, true},
+		{Options{TotalPolicy: TotalAggregate, Objects: map[uint]*ObjectOptions{2916: {TotalInstance: "TotalBackup"}}}, true, false, true},
+	} {
+		source := &perflib.FakeSource{Snapshots: map[string]*perflib.Snapshot{"": snapshot}}
+		c := NewPerflibCollectorWithOptions(log.NewNopLogger(), source, "Global", tc.options)
+
+		metrics := collectMetrics(t, c)
+
+		if findMetric(metrics, "Default Web Site", "perflib_web_service_current_connections") == nil {
+			t.Errorf("%+v: expected regular instances to be kept", tc.options)
+		}
+
+		if (findMetric(metrics, "_Total", "perflib_web_service_current_connections") != nil) != tc.total {
+			t.Errorf("%+v: expected _Total to be kept: %v", tc.options, tc.total)
+		}
+		if (findMetric(metrics, "TotalBackup", "perflib_web_service_current_connections") != nil) != tc.backup {
+			t.Errorf("%+v: expected TotalBackup to be kept: %v", tc.options, tc.backup)
+		}
+
+		aggregate := findMetric(metrics, "", "perflib_web_service_aggregate_current_connections")
+		if (aggregate != nil) != tc.aggregate {
+			t.Errorf("%+v: expected an aggregate: %v", tc.options, tc.aggregate)
+		}
+		if aggregate != nil && len(aggregate.Label) != 0 {
+			t.Errorf("expected no labels on the aggregate, got %v", aggregate.Label)
+		}
+
+		// Aggregates have no instance labels, so there is only one
+		ch := make(chan prometheus.Metric, 100)
+		if err := c.Collect(ch); err != nil {
+			t.Fatal(err)
+		}
+		close(ch)
+
+		n := 0
+		for m := range ch {
+			if strings.Contains(m.Desc().String(), "perflib_web_service_aggregate_") {
+				n++
+			}
+		}
+		if tc.aggregate && n != 1 {
+			t.Errorf("%+v: expected a single aggregate, got %d", tc.options, n)
+		}
+	}
+}
+
+func TestPerflibCollectorObjectOptions(t *testing.T) {
+	b := perflibtest.New()
+
+	process := b.AddObject(230)
+	process.AddCounter(142, PERF_100NSEC_TIMER, 8)
+	process.AddCounter(144, PERF_100NSEC_TIMER, 8)
+	process.AddCounter(180, PERF_COUNTER_LARGE_RAWCOUNT, 8)
+	process.AddCounter(784, PERF_COUNTER_RAWCOUNT, 4)
+	process.AddInstance("Idle", 0, 0, 8192, 0)
+	process.AddInstance("svchost", 30000000, 10000000, 4096, 928)
+
+	names := map[uint32]string{
+		230: "Process",
+		142: "% User Time",
+		144: "% Privileged Time",
+		180: "Working Set",
+		784: "ID Process",
+	}
+
+	snapshot := parseSnapshot(t, b, names)
+
+	source := &perflib.FakeSource{Snapshots: map[string]*perflib.Snapshot{"": snapshot}}
+	c := NewPerflibCollectorWithOptions(log.NewNopLogger(), source, "230", Options{
+		Objects: map[uint]*ObjectOptions{230: {
+			Renames:        map[uint]string{180: "working_set_bytes"},
+			PromotedLabels: []PromotedLabel{{Label: "pid", Counters: []uint{784}}},
+			MergedLabels: []MergedLabel{{
+				Metric: "cpu_time_total",
+				Label:  "mode",
+				Values: map[uint]string{142: "user", 144: "privileged"},
+			}},
+			Exclude: []*regexp.Regexp{regexp.MustCompile("^Idle$")},
+		}},
+	})
+
+	metrics := collectMetrics(t, c)
+
+	if m := findMetric(metrics, "Idle", "perflib_process_working_set_bytes"); m != nil {
+		t.Errorf("expected excluded instance to be dropped, got %v", m)
+	}
+
+	ws := findMetric(metrics, "svchost", "perflib_process_working_set_bytes")
+	if ws == nil || ws.GetGauge().GetValue() != 4096 {
+		t.Fatalf("unexpected working set %v", ws)
+	}
+	if len(ws.Label) != 2 || ws.Label[1].GetName() != "pid" || ws.Label[1].GetValue() != "928" {
+		t.Errorf("expected a pid label, got %v", ws.Label)
+	}
+
+	if findMetric(metrics, "svchost", "perflib_process_id_process") != nil {
+		t.Error("expected the promoted counter not to be exported as a metric")
+	}
+
+	// Both counters end up in the same metric, so collectMetrics only keeps
+	// one of them
+	n := 0
+	for k, m := range metrics {
+		if strings.Contains(k, `fqName: "perflib_process_cpu_time_total"`) {
+			n++
+		}
+		for _, l := range m.Label {
+			if l.GetName() == "mode" && l.GetValue() != "user" && l.GetValue() != "privileged" {
+				t.Errorf("unexpected mode %q", l.GetValue())
+			}
+		}
+	}
+	if n != 1 {
+		t.Errorf("expected a merged metric, got %d", n)
+	}
+
+	// The merged metric is consistent, so it can be gathered by a registry
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+		if err := c.Collect(ch); err != nil {
+			t.Error(err)
+		}
+	}))
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range families {
+		if f.GetName() == "perflib_process_cpu_time_total" && len(f.Metric) != 2 {
+			t.Errorf("expected user and privileged time, got %v", f.Metric)
+		}
+	}
+
+	if labels := c.PromotedLabels(230); len(labels) != 1 || labels[0] != "pid" {
+		t.Errorf("unexpected promoted labels %v", labels)
+	}
+
+	// Objects without options keep the built-in defaults
+	c = NewPerflibCollectorWithOptions(log.NewNopLogger(), source, "230", Options{
+		Objects: map[uint]*ObjectOptions{4: {}},
+	})
+
+	if labels := c.PromotedLabels(230); len(labels) != 2 || labels[0] != "process_id" {
+		t.Errorf("unexpected promoted labels %v", labels)
+	}
+}
+
+// Unchecked collector, for gathering metrics without descriptions
+type collectorFunc func(ch chan<- prometheus.Metric)
+
+func (f collectorFunc) Describe(chan<- *prometheus.Desc) {}
+
+func (f collectorFunc) Collect(ch chan<- prometheus.Metric) {
+	f(ch)
+}
+
+func TestParseTotalPolicy(t *testing.T) {
+	if p, err := ParseTotalPolicy("aggregate"); err != nil || p != TotalAggregate {
+		t.Errorf("unexpected policy %q (%v)", p, err)
+	}
+	if _, err := ParseTotalPolicy("sum"); err == nil {
+		t.Error("expected an error for an invalid policy")
+	}
+}
+
+// Scrapes and /dump run concurrently against the same collector and source.
+// Meant to be run with -race.
+func TestPerflibCollectorConcurrent(t *testing.T) {
+	source := &perflib.FakeSource{Snapshots: map[string]*perflib.Snapshot{"": testSnapshot(t)}}
+	c := NewPerflibCollector(log.NewNopLogger(), source, "236")
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+
+			ch := make(chan prometheus.Metric, 100)
+			if err := c.Collect(ch); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			if _, err := source.Query("Global"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if n := len(source.Queries()); n != 20 {
+		t.Errorf("expected 20 queries, got %d", n)
+	}
+}
+
+func TestMakePrometheusLabel(t *testing.T) {
+	for _, tc := range []struct {
+		def      perflib.PerfCounterDef
+		expected string
+	}{
+		{perflib.PerfCounterDef{Name: "File Read Operations/sec", CounterType: PERF_COUNTER_COUNTER}, "file_read_operations_total"},
+		{perflib.PerfCounterDef{Name: "Processor Queue Length", CounterType: PERF_COUNTER_RAWCOUNT}, "processor_queue_length"},
+		{perflib.PerfCounterDef{Name: "Free & Zero Page List Bytes", CounterType: PERF_COUNTER_LARGE_RAWCOUNT}, "free_and_zero_page_list_bytes"},
+		{perflib.PerfCounterDef{Name: "Avg. Disk sec/Transfer", CounterType: PERF_AVERAGE_TIMER}, "avg_disk_sec_per_transfer"},
+		{perflib.PerfCounterDef{Name: "% Registry Quota In Use", CounterType: PERF_RAW_BASE}, "registry_quota_in_use_max"},
+		{perflib.PerfCounterDef{Name: "# of resumed workflow jobs/sec", CounterType: PERF_COUNTER_COUNTER}, "resumed_workflow_jobs_total"},
+	} {
+		if label := MakePrometheusLabel(&tc.def); label != tc.expected {
+			t.Errorf("%q: expected %s, got %s", tc.def.Name, tc.expected, label)
+		}
+	}
+}
+
+// Process IDs are promoted to labels by default
+func TestPerflibCollectorDefaultPromotedLabels(t *testing.T) {
+	b := perflibtest.New()
+
+	process := b.AddObject(230)
+	process.AddCounter(6, PERF_100NSEC_TIMER, 8)
+	process.AddCounter(784, PERF_COUNTER_RAWCOUNT, 4)
+	process.AddCounter(1410, PERF_COUNTER_RAWCOUNT, 4)
+	process.AddInstance("Idle", 0, 0, 0)
+	process.AddInstance("svchost", 1000, 928, 620)
+
+	_, objects, err := perflib.ParsePerformanceData(b.Bytes(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewPerflibCollector(log.NewNopLogger(), &perflib.FakeSource{}, "230")
+
+	if labels := c.PromotedLabels(230); len(labels) != 2 || labels[0] != "process_id" || labels[1] != "creating_process_id" {
+		t.Errorf("unexpected labels %v", labels)
+	}
+
+	values := c.PromotedLabelValues(230, objects[0].Instances[1])
+
+	if len(values) != 2 || values[0] != "928" || values[1] != "620" {
+		t.Errorf("unexpected label values %v", values)
+	}
+}
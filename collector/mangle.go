@@ -45,9 +45,12 @@ func MakePrometheusLabel(def *perflib.PerfCounterDef) (s string) {
 	s = manglePerflibCounterName(def.Name)
 
 	if len(s) > 0 {
-		if IsCounter(def.CounterType) {
+		switch {
+		case IsAverage(def.CounterType):
+			// Exported as a summary, which adds its own _sum and _count suffixes
+		case IsCounter(def.CounterType):
 			s += "_total"
-		} else if IsBaseValue(def.CounterType) && !strings.HasSuffix(s, "_base") {
+		case IsBaseValue(def.CounterType) && !strings.HasSuffix(s, "_base"):
 			s += "_max"
 		}
 	}
@@ -59,31 +62,40 @@ func pdhNameFromCounterDef(obj perflib.PerfObject, def perflib.PerfCounterDef) s
 	return fmt.Sprintf(`\%s(*)\%s`, obj.Name, def.Name)
 }
 
-func descFromCounterDef(obj perflib.PerfObject, def perflib.PerfCounterDef) *prometheus.Desc {
+// Aggregate descriptions are for total instances, which are exported without
+// instance labels under a separate name (see TotalAggregate). opts may be nil.
+func descFromCounterDef(obj perflib.PerfObject, def perflib.PerfCounterDef, aggregate bool, opts *ObjectOptions) *prometheus.Desc {
 	subsystem := manglePerflibName(obj.Name)
 	counterName := MakePrometheusLabel(&def)
+	help := fmt.Sprintf("perflib metric: %s (see /dump for docs) [%d]",
+		pdhNameFromCounterDef(obj, def), def.NameIndex)
+
+	if name, ok := opts.rename(def.NameIndex); ok {
+		counterName = name
+	}
 
 	labels := []string{"name"}
 
-	if len(obj.Instances) == 1 {
+	if !isMultiInstance(&obj) || aggregate {
 		labels = []string{}
 	}
 
-	if HasPromotedLabels(obj.NameIndex) {
-		labels = append(labels, PromotedLabelsForObject(obj.NameIndex)...)
+	if aggregate {
+		subsystem += "_aggregate"
+	} else {
+		labels = append(labels, opts.promotedLabelNames()...)
 	}
 
-	// TODO - Label merging needs to be fixed for [230] Process
-	//if HasMergedLabels(obj.NameIndex) {
-	//	s, labelsForObject := MergedLabelsForInstance(obj.NameIndex, def.NameIndex)
-	//	counterName = s
-	//	labels = append(labels, labelsForObject)
-	//}
+	// All counters of a merged metric need the same help text
+	if merge, _ := opts.mergedLabel(def.NameIndex); merge != nil {
+		counterName = merge.Metric
+		labels = append(labels, merge.Label)
+		help = fmt.Sprintf("perflib metric: \\%s(*) counters by %s (see /dump for docs)", obj.Name, merge.Label)
+	}
 
 	return prometheus.NewDesc(
 		prometheus.BuildFQName(Namespace, subsystem, counterName),
-		fmt.Sprintf("perflib metric: %s (see /dump for docs) [%d]",
-			pdhNameFromCounterDef(obj, def), def.NameIndex),
+		help,
 		labels,
 		nil,
 	)
@@ -1,3 +1,6 @@
+//go:build windows
+// +build windows
+
 package collector
 
 import (
@@ -54,8 +57,8 @@ func ExampleMakePrometheusLabel() {
 10 file_read_operations_total
 44 processor_queue_length
 94 data_map_hits_total
-206 avg_disk_sec_per_transfer_total
-228 avg_disk_bytes_per_write_total
+206 avg_disk_sec_per_transfer
+228 avg_disk_bytes_per_write
 388 bytes_total
 1260 logon
 1262 durable_handles
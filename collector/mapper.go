@@ -51,23 +51,102 @@ const (
 )
 
 var supportedCounterTypes = map[uint32]prometheus.ValueType{
-	PERF_COUNTER_RAWCOUNT_HEX:       prometheus.GaugeValue,
-	PERF_COUNTER_LARGE_RAWCOUNT_HEX: prometheus.GaugeValue,
-	PERF_COUNTER_RAWCOUNT:           prometheus.GaugeValue,
-	PERF_COUNTER_LARGE_RAWCOUNT:     prometheus.GaugeValue,
-	PERF_COUNTER_DELTA:              prometheus.CounterValue,
-	PERF_COUNTER_COUNTER:            prometheus.CounterValue,
-	PERF_COUNTER_BULK_COUNT:         prometheus.CounterValue,
-	PERF_RAW_FRACTION:               prometheus.GaugeValue,
-	PERF_LARGE_RAW_FRACTION:         prometheus.GaugeValue,
-	PERF_100NSEC_TIMER:              prometheus.CounterValue,
-	PERF_PRECISION_100NS_TIMER:      prometheus.CounterValue,
-	PERF_SAMPLE_FRACTION:            prometheus.GaugeValue,
-	PERF_100NSEC_TIMER_INV:          prometheus.CounterValue,
-	PERF_ELAPSED_TIME:               prometheus.GaugeValue,
-	PERF_SAMPLE_BASE:                prometheus.GaugeValue,
-	PERF_RAW_BASE:                   prometheus.GaugeValue,
-	PERF_LARGE_RAW_BASE:             prometheus.GaugeValue,
+	PERF_COUNTER_RAWCOUNT_HEX:           prometheus.GaugeValue,
+	PERF_COUNTER_LARGE_RAWCOUNT_HEX:     prometheus.GaugeValue,
+	PERF_COUNTER_RAWCOUNT:               prometheus.GaugeValue,
+	PERF_COUNTER_LARGE_RAWCOUNT:         prometheus.GaugeValue,
+	PERF_COUNTER_DELTA:                  prometheus.CounterValue,
+	PERF_COUNTER_LARGE_DELTA:            prometheus.CounterValue,
+	PERF_SAMPLE_COUNTER:                 prometheus.CounterValue,
+	PERF_COUNTER_QUEUELEN_TYPE:          prometheus.CounterValue,
+	PERF_COUNTER_LARGE_QUEUELEN_TYPE:    prometheus.CounterValue,
+	PERF_COUNTER_100NS_QUEUELEN_TYPE:    prometheus.CounterValue,
+	PERF_COUNTER_OBJ_TIME_QUEUELEN_TYPE: prometheus.CounterValue,
+	PERF_COUNTER_COUNTER:                prometheus.CounterValue,
+	PERF_COUNTER_BULK_COUNT:             prometheus.CounterValue,
+	PERF_RAW_FRACTION:                   prometheus.GaugeValue,
+	PERF_LARGE_RAW_FRACTION:             prometheus.GaugeValue,
+	PERF_COUNTER_TIMER:                  prometheus.CounterValue,
+	PERF_PRECISION_SYSTEM_TIMER:         prometheus.CounterValue,
+	PERF_100NSEC_TIMER:                  prometheus.CounterValue,
+	PERF_PRECISION_100NS_TIMER:          prometheus.CounterValue,
+	PERF_OBJ_TIME_TIMER:                 prometheus.CounterValue,
+	PERF_PRECISION_OBJECT_TIMER:         prometheus.CounterValue,
+	PERF_SAMPLE_FRACTION:                prometheus.GaugeValue,
+	PERF_COUNTER_TIMER_INV:              prometheus.CounterValue,
+	PERF_100NSEC_TIMER_INV:              prometheus.CounterValue,
+	PERF_COUNTER_MULTI_TIMER:            prometheus.CounterValue,
+	PERF_100NSEC_MULTI_TIMER:            prometheus.CounterValue,
+	PERF_COUNTER_MULTI_TIMER_INV:        prometheus.CounterValue,
+	PERF_100NSEC_MULTI_TIMER_INV:        prometheus.CounterValue,
+	PERF_ELAPSED_TIME:                   prometheus.GaugeValue,
+	PERF_SAMPLE_BASE:                    prometheus.GaugeValue,
+	PERF_RAW_BASE:                       prometheus.GaugeValue,
+	PERF_LARGE_RAW_BASE:                 prometheus.GaugeValue,
+	PERF_PRECISION_TIMESTAMP:            prometheus.CounterValue,
+	PERF_COUNTER_MULTI_BASE:             prometheus.GaugeValue,
+
+	// Averages are exported as summaries. The count is taken from the
+	// PERF_AVERAGE_BASE counter that follows the numerator.
+	PERF_AVERAGE_TIMER: prometheus.CounterValue,
+	PERF_AVERAGE_BULK:  prometheus.CounterValue,
+}
+
+// Unit a timer-class counter counts in
+type timeBase int
+
+const (
+	// Ticks of the data block's PerfFreq (PERF_TIMER_TICK)
+	timeBaseSystem timeBase = iota + 1
+	// 100ns units (PERF_TIMER_100NS)
+	timeBase100ns
+	// Ticks of the object's PerfFreq (PERF_OBJECT_TIMER)
+	timeBaseObject
+)
+
+// Queue length counters accumulate the queue length once per tick of their
+// time base, so rate() of the scaled value is the average queue length.
+var timerCounterTypes = map[uint32]timeBase{
+	PERF_COUNTER_TIMER:                  timeBaseSystem,
+	PERF_COUNTER_TIMER_INV:              timeBaseSystem,
+	PERF_COUNTER_MULTI_TIMER:            timeBaseSystem,
+	PERF_COUNTER_MULTI_TIMER_INV:        timeBaseSystem,
+	PERF_PRECISION_SYSTEM_TIMER:         timeBaseSystem,
+	PERF_AVERAGE_TIMER:                  timeBaseSystem,
+	PERF_COUNTER_QUEUELEN_TYPE:          timeBaseSystem,
+	PERF_COUNTER_LARGE_QUEUELEN_TYPE:    timeBaseSystem,
+	PERF_100NSEC_TIMER:                  timeBase100ns,
+	PERF_100NSEC_TIMER_INV:              timeBase100ns,
+	PERF_100NSEC_MULTI_TIMER:            timeBase100ns,
+	PERF_100NSEC_MULTI_TIMER_INV:        timeBase100ns,
+	PERF_PRECISION_100NS_TIMER:          timeBase100ns,
+	PERF_COUNTER_100NS_QUEUELEN_TYPE:    timeBase100ns,
+	PERF_OBJ_TIME_TIMER:                 timeBaseObject,
+	PERF_PRECISION_OBJECT_TIMER:         timeBaseObject,
+	PERF_COUNTER_OBJ_TIME_QUEUELEN_TYPE: timeBaseObject,
+}
+
+// Factor which converts the raw value of a timer-class counter to seconds, given
+// the frequencies of its object and data block. Returns 1 for all other counters.
+func TimerScaleFactor(counterType uint32, objectFreq, systemFreq int64) float64 {
+	var freq int64
+
+	switch timerCounterTypes[counterType] {
+	case timeBase100ns:
+		return hundredNsToSecondsScaleFactor
+	case timeBaseSystem:
+		freq = systemFreq
+	case timeBaseObject:
+		freq = objectFreq
+	default:
+		return 1
+	}
+
+	if freq == 0 {
+		return 1
+	}
+
+	return 1 / float64(freq)
 }
 
 func IsCounter(counterType uint32) bool {
@@ -78,6 +157,10 @@ func IsBaseValue(counterType uint32) bool {
 	return counterType == PERF_SAMPLE_BASE || counterType == PERF_RAW_BASE || counterType == PERF_LARGE_RAW_BASE
 }
 
+func IsAverage(counterType uint32) bool {
+	return counterType == PERF_AVERAGE_TIMER || counterType == PERF_AVERAGE_BULK
+}
+
 func IsElapsedTime(counterType uint32) bool {
 	return counterType == PERF_ELAPSED_TIME
 }
@@ -0,0 +1,48 @@
+package collector
+
+import (
+	"math"
+	"testing"
+)
+
+func TestTimerScaleFactor(t *testing.T) {
+	const (
+		objectFreq = 1000
+		systemFreq = 10000000
+	)
+
+	for _, tc := range []struct {
+		name        string
+		counterType uint32
+		expected    float64
+	}{
+		{"PERF_COUNTER_TIMER", PERF_COUNTER_TIMER, 1e-7},
+		{"PERF_COUNTER_MULTI_TIMER_INV", PERF_COUNTER_MULTI_TIMER_INV, 1e-7},
+		{"PERF_PRECISION_SYSTEM_TIMER", PERF_PRECISION_SYSTEM_TIMER, 1e-7},
+		{"PERF_AVERAGE_TIMER", PERF_AVERAGE_TIMER, 1e-7},
+		{"PERF_COUNTER_QUEUELEN_TYPE", PERF_COUNTER_QUEUELEN_TYPE, 1e-7},
+		{"PERF_COUNTER_LARGE_QUEUELEN_TYPE", PERF_COUNTER_LARGE_QUEUELEN_TYPE, 1e-7},
+		{"PERF_100NSEC_TIMER", PERF_100NSEC_TIMER, 1e-7},
+		{"PERF_PRECISION_100NS_TIMER", PERF_PRECISION_100NS_TIMER, 1e-7},
+		{"PERF_COUNTER_100NS_QUEUELEN_TYPE", PERF_COUNTER_100NS_QUEUELEN_TYPE, 1e-7},
+		{"PERF_OBJ_TIME_TIMER", PERF_OBJ_TIME_TIMER, 1e-3},
+		{"PERF_PRECISION_OBJECT_TIMER", PERF_PRECISION_OBJECT_TIMER, 1e-3},
+		{"PERF_COUNTER_OBJ_TIME_QUEUELEN_TYPE", PERF_COUNTER_OBJ_TIME_QUEUELEN_TYPE, 1e-3},
+		{"PERF_COUNTER_COUNTER", PERF_COUNTER_COUNTER, 1},
+		{"PERF_COUNTER_RAWCOUNT", PERF_COUNTER_RAWCOUNT, 1},
+		{"PERF_AVERAGE_BULK", PERF_AVERAGE_BULK, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			factor := TimerScaleFactor(tc.counterType, objectFreq, systemFreq)
+
+			if math.Abs(factor-tc.expected) > 1e-15 {
+				t.Errorf("expected %v, got %v", tc.expected, factor)
+			}
+		})
+	}
+
+	// Without a known frequency, values are passed through unchanged
+	if factor := TimerScaleFactor(PERF_OBJ_TIME_TIMER, 0, systemFreq); factor != 1 {
+		t.Errorf("expected 1 without an object frequency, got %v", factor)
+	}
+}
@@ -1,17 +0,0 @@
-package collector
-
-import "fmt"
-
-func ExampleMergedLabelsForInstance() {
-	fmt.Println(MergedLabelsForInstance(230, 142))
-
-	// Output:
-	// processor_time_total mode
-}
-
-func ExampleMergedMetricForInstance() {
-	fmt.Println(MergedMetricForInstance(230, 142))
-
-	// Output:
-	// processor_time_total user
-}
\ No newline at end of file
@@ -0,0 +1,166 @@
+package collector
+
+import (
+	"regexp"
+	"strconv"
+
+	"github.com/leoluk/perflib_exporter/perflib"
+)
+
+/*
+Options for a single object, usually loaded from the configuration file (see
+package config). Counters are referenced by index. Since counter names aren't
+unique, a counter configured by name may resolve to several indices, all of
+which are listed.
+*/
+type ObjectOptions struct {
+	// Metric names (without the namespace and object prefix) by counter index,
+	// replacing the name derived from the counter name
+	Renames map[uint]string
+
+	// Counters exported as labels on all other metrics of an instance
+	PromotedLabels []PromotedLabel
+
+	// Groups of counters exported as a single metric, distinguished by a label
+	MergedLabels []MergedLabel
+
+	// Only instances matching any of Include (if set) and none of Exclude are collected
+	Include []*regexp.Regexp
+	Exclude []*regexp.Regexp
+
+	// Name of the instance exported by TotalAggregate. Defaults to "_Total".
+	TotalInstance string
+}
+
+type PromotedLabel struct {
+	Label    string
+	Counters []uint
+}
+
+type MergedLabel struct {
+	Metric string
+	Label  string
+	// Label value by counter index
+	Values map[uint]string
+}
+
+// Built-in object options, used for objects not listed in Options.Objects
+var defaultObjectOptions = map[uint]*ObjectOptions{
+	// Process
+	230: {
+		PromotedLabels: []PromotedLabel{
+			{Label: "process_id", Counters: []uint{784}},
+			{Label: "creating_process_id", Counters: []uint{1410}},
+		},
+	},
+}
+
+// Names of the promoted labels, in the order of PromotedLabels.
+func (o *ObjectOptions) promotedLabelNames() []string {
+	if o == nil {
+		return nil
+	}
+
+	labels := make([]string, len(o.PromotedLabels))
+
+	for i, p := range o.PromotedLabels {
+		labels[i] = p.Label
+	}
+
+	return labels
+}
+
+// Values of the promoted labels for an instance, in the order of PromotedLabels.
+func (o *ObjectOptions) promotedLabelValues(instance *perflib.PerfInstance) []string {
+	if o == nil {
+		return nil
+	}
+
+	values := make([]string, len(o.PromotedLabels))
+
+	for i, p := range o.PromotedLabels {
+	counters:
+		for _, c := range instance.Counters {
+			for _, index := range p.Counters {
+				if c.Def.NameIndex == index {
+					values[i] = strconv.FormatInt(c.Value, 10)
+					break counters
+				}
+			}
+		}
+	}
+
+	return values
+}
+
+func (o *ObjectOptions) isPromotedLabel(counterIndex uint) bool {
+	if o == nil {
+		return false
+	}
+
+	for _, p := range o.PromotedLabels {
+		for _, index := range p.Counters {
+			if index == counterIndex {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Return the merged metric a counter belongs to and its label value, or nil.
+func (o *ObjectOptions) mergedLabel(counterIndex uint) (*MergedLabel, string) {
+	if o == nil {
+		return nil, ""
+	}
+
+	for i := range o.MergedLabels {
+		if value, ok := o.MergedLabels[i].Values[counterIndex]; ok {
+			return &o.MergedLabels[i], value
+		}
+	}
+
+	return nil, ""
+}
+
+func (o *ObjectOptions) rename(counterIndex uint) (string, bool) {
+	if o == nil {
+		return "", false
+	}
+
+	name, ok := o.Renames[counterIndex]
+	return name, ok
+}
+
+func (o *ObjectOptions) totalInstance() string {
+	if o == nil || o.TotalInstance == "" {
+		return defaultTotalInstance
+	}
+
+	return o.TotalInstance
+}
+
+func (o *ObjectOptions) includeInstance(name string) bool {
+	if o == nil {
+		return true
+	}
+
+	for _, re := range o.Exclude {
+		if re.MatchString(name) {
+			return false
+		}
+	}
+
+	if len(o.Include) == 0 {
+		return true
+	}
+
+	for _, re := range o.Include {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,42 @@
+package collector
+
+import (
+	"fmt"
+	"strings"
+)
+
+// How instances which aggregate all other instances of an object (like "_Total")
+// are exported.
+type TotalPolicy string
+
+const (
+	// Drop total instances. They do not fit into the Prometheus model - you'd
+	// sum() the other instances instead.
+	TotalDrop TotalPolicy = "drop"
+	// Export total instances like any other instance, with their name as label
+	TotalKeep TotalPolicy = "keep"
+	// Export the total instance (see ObjectOptions.TotalInstance) as separate
+	// metrics, with an "_aggregate" suffix on the object name and without
+	// instance labels. All other instances are exported as usual.
+	TotalAggregate TotalPolicy = "aggregate"
+)
+
+// Name of the total instance exported by TotalAggregate, unless configured otherwise
+const defaultTotalInstance = "_Total"
+
+func ParseTotalPolicy(s string) (TotalPolicy, error) {
+	switch p := TotalPolicy(s); p {
+	case TotalDrop, TotalKeep, TotalAggregate:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid total policy %q (valid: drop, keep, aggregate)", s)
+	}
+}
+
+// Whether an instance looks like it holds the total of all other instances, as
+// dropped by TotalDrop. This matches "_Total" as well as the "Total" and
+// "Total_Sessions" style used by some providers, but also regular instances
+// which happen to start with "Total".
+func isTotalInstance(name string) bool {
+	return strings.HasSuffix(name, "_Total") || strings.HasPrefix(name, "Total")
+}
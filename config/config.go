@@ -0,0 +1,586 @@
+/*
+Package config loads the configuration file passed via --config.file, which
+selects objects and customizes how they are exported:
+
+	objects:
+	  # Objects are referenced by index or by name (English or localized)
+	  - name: Process
+	    # Metric names, by counter, replacing the name derived from the counter name
+	    renames:
+	      Elapsed Time: start_time_seconds
+	    # Counters exported as labels on all other metrics of an instance
+	    promoted_labels:
+	      - label: process_id
+	        counter: ID Process
+	      - label: creating_process_id
+	        counter: 1410
+	    # Counters exported as a single metric, distinguished by a label
+	    merged_labels:
+	      - metric: processor_time_total
+	        label: mode
+	        counters:
+	          "% User Time": user
+	          "% Privileged Time": privileged
+	    # Regular expressions on instance names, anchored at both ends
+	    instances:
+	      exclude: [Idle]
+	    # How the _Total instance is exported: drop, keep or aggregate
+	    totals: drop
+	    # Instance exported by "totals: aggregate", if it isn't called _Total
+	    total_instance: _Total
+
+	  - index: 238
+
+Counters are referenced by index or by name. Counter names aren't unique, so a
+name applies to every counter index with that name.
+
+All names are validated against the name tables when the configuration is
+resolved, and metric names set by renames and merged labels must be unique
+within an object. They also must not collide with the metric names derived from
+the object's other counters, which is checked against the objects on this machine. Objects listed in the file only get the options given there, which
+replaces the built-in label promotion for Process.
+*/
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/leoluk/perflib_exporter/collector"
+	"github.com/leoluk/perflib_exporter/perflib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+type Config struct {
+	Objects []ObjectConfig `yaml:"objects"`
+}
+
+type ObjectConfig struct {
+	// Either Index or Name
+	Index uint   `yaml:"index"`
+	Name  string `yaml:"name"`
+
+	Renames        map[Ref]string        `yaml:"renames"`
+	PromotedLabels []PromotedLabelConfig `yaml:"promoted_labels"`
+	MergedLabels   []MergedLabelConfig   `yaml:"merged_labels"`
+	Instances      InstanceFilterConfig  `yaml:"instances"`
+	Totals         string                `yaml:"totals"`
+	TotalInstance  string                `yaml:"total_instance"`
+}
+
+type PromotedLabelConfig struct {
+	Label   string `yaml:"label"`
+	Counter Ref    `yaml:"counter"`
+}
+
+type MergedLabelConfig struct {
+	Metric   string         `yaml:"metric"`
+	Label    string         `yaml:"label"`
+	Counters map[Ref]string `yaml:"counters"`
+}
+
+type InstanceFilterConfig struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+// A reference to a counter, either by index or by name.
+type Ref struct {
+	Index uint
+	Name  string
+}
+
+func (r *Ref) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var index uint
+
+	if err := unmarshal(&index); err == nil {
+		*r = Ref{Index: index}
+		return nil
+	}
+
+	var name string
+
+	if err := unmarshal(&name); err != nil {
+		return err
+	}
+
+	*r = Ref{Name: name}
+	return nil
+}
+
+func (r Ref) String() string {
+	if r.Name != "" {
+		return fmt.Sprintf("%q", r.Name)
+	}
+
+	return fmt.Sprint(r.Index)
+}
+
+// Parse a configuration file. Unknown fields are an error.
+func Parse(data []byte) (*Config, error) {
+	c := new(Config)
+
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+
+	return c, nil
+}
+
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(data)
+}
+
+// A configuration with all names resolved to indices.
+type Resolved struct {
+	// Objects to query, in the order of the configuration file
+	Objects []uint
+
+	// Options for collector.Options, by object index
+	ObjectOptions       map[uint]*collector.ObjectOptions
+	ObjectTotalPolicies map[uint]collector.TotalPolicy
+}
+
+var metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+/*
+Resolve and validate all object and counter references. Names are looked up
+in all of the given name tables (usually the English one and the one for
+--perflib.language), indices need to exist in at least one of them.
+
+Counter types and the counters of an object aren't part of the name tables. If
+source is not nil, objects with renames or merged labels are queried to check
+that all counters of a merged metric are exported with the same type, and that
+configured metric names don't collide with the names derived from the object's
+other counters. Objects missing from the result aren't checked.
+*/
+func (c *Config) Resolve(source perflib.Source, tables ...*perflib.NameTable) (*Resolved, error) {
+	r := &Resolved{
+		ObjectOptions:       make(map[uint]*collector.ObjectOptions),
+		ObjectTotalPolicies: make(map[uint]collector.TotalPolicy),
+	}
+
+	for i := range c.Objects {
+		o := &c.Objects[i]
+
+		index, err := resolveObject(o, tables)
+
+		if err != nil {
+			return nil, fmt.Errorf("objects[%d]: %v", i, err)
+		}
+
+		if _, ok := r.ObjectOptions[index]; ok {
+			return nil, fmt.Errorf("objects[%d]: object %d is listed more than once", i, index)
+		}
+
+		opts, err := resolveObjectOptions(o, tables)
+
+		if err != nil {
+			return nil, fmt.Errorf("objects[%d] (%d): %v", i, index, err)
+		}
+
+		if o.Totals != "" {
+			policy, err := collector.ParseTotalPolicy(o.Totals)
+
+			if err != nil {
+				return nil, fmt.Errorf("objects[%d] (%d): %v", i, index, err)
+			}
+
+			r.ObjectTotalPolicies[index] = policy
+		}
+
+		r.Objects = append(r.Objects, index)
+		r.ObjectOptions[index] = opts
+	}
+
+	if source != nil {
+		if err := r.checkCounters(source); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// Check the configured metric names against the counters an object actually
+// has, see Resolve.
+func (r *Resolved) checkCounters(source perflib.Source) error {
+	var query []string
+	position := make(map[uint]int)
+
+	for i, index := range r.Objects {
+		if opts := r.ObjectOptions[index]; len(opts.Renames) > 0 || len(opts.MergedLabels) > 0 {
+			query = append(query, strconv.FormatUint(uint64(index), 10))
+			position[index] = i
+		}
+	}
+
+	if len(query) == 0 {
+		return nil
+	}
+
+	snapshot, err := source.Query(strings.Join(query, " "))
+
+	if err != nil {
+		return fmt.Errorf("failed to query objects with renames or merged labels: %v", err)
+	}
+
+	for _, object := range snapshot.Objects {
+		i, ok := position[object.NameIndex]
+
+		if !ok {
+			continue
+		}
+
+		if err := checkMergedTypes(object, r.ObjectOptions[object.NameIndex]); err != nil {
+			return fmt.Errorf("objects[%d] (%d): %v", i, object.NameIndex, err)
+		}
+
+		if err := checkDerivedNames(object, r.ObjectOptions[object.NameIndex]); err != nil {
+			return fmt.Errorf("objects[%d] (%d): %v", i, object.NameIndex, err)
+		}
+	}
+
+	return nil
+}
+
+// Counters of a merged metric end up in the same metric family, so they need
+// to have the same type.
+func checkMergedTypes(object *perflib.PerfObject, opts *collector.ObjectOptions) error {
+	for _, m := range opts.MergedLabels {
+		var first *perflib.PerfCounterDef
+
+		for _, def := range object.CounterDefs {
+			if _, ok := m.Values[def.NameIndex]; !ok || metricType(def.CounterType) == "" {
+				continue
+			}
+
+			if first == nil {
+				first = def
+			} else if metricType(def.CounterType) != metricType(first.CounterType) {
+				return fmt.Errorf("counters of merged metric %q have different types (%d is a %s, %d is a %s)",
+					m.Metric, first.NameIndex, metricType(first.CounterType), def.NameIndex, metricType(def.CounterType))
+			}
+		}
+	}
+
+	return nil
+}
+
+// Renamed and merged metrics must not end up with the name the collector
+// derives for another counter of the object (see collector.MakePrometheusLabel).
+func checkDerivedNames(object *perflib.PerfObject, opts *collector.ObjectOptions) error {
+	configured := make(map[string]bool)
+	skip := make(map[uint]bool)
+
+	for index, name := range opts.Renames {
+		configured[name] = true
+		skip[index] = true
+	}
+
+	for _, m := range opts.MergedLabels {
+		configured[m.Metric] = true
+
+		for index := range m.Values {
+			skip[index] = true
+		}
+	}
+
+	for _, p := range opts.PromotedLabels {
+		for _, index := range p.Counters {
+			skip[index] = true
+		}
+	}
+
+	// Average bases are exported as part of their numerator's summary
+	bases := make(map[*perflib.PerfCounterDef]bool)
+
+	for _, def := range object.CounterDefs {
+		if collector.IsAverage(def.CounterType) && def.Base != nil {
+			bases[def.Base] = true
+		}
+	}
+
+	for _, def := range object.CounterDefs {
+		if skip[def.NameIndex] || bases[def] || metricType(def.CounterType) == "" {
+			continue
+		}
+
+		if name := collector.MakePrometheusLabel(def); configured[name] {
+			return fmt.Errorf("metric name %q collides with the name of counter %d (%q)", name, def.NameIndex, def.Name)
+		}
+	}
+
+	return nil
+}
+
+// Type a counter is exported as, or "" if the collector doesn't support it
+func metricType(counterType uint32) string {
+	if collector.IsAverage(counterType) {
+		return "summary"
+	}
+
+	valueType, err := collector.GetPrometheusValueType(counterType)
+
+	switch {
+	case err != nil:
+		return ""
+	case valueType == prometheus.CounterValue:
+		return "counter"
+	default:
+		return "gauge"
+	}
+}
+
+func resolveObject(o *ObjectConfig, tables []*perflib.NameTable) (uint, error) {
+	if (o.Index == 0) == (o.Name == "") {
+		return 0, fmt.Errorf("exactly one of index and name is required")
+	}
+
+	if o.Name == "" {
+		if !hasIndex(tables, o.Index) {
+			return 0, fmt.Errorf("unknown object index %d", o.Index)
+		}
+
+		return o.Index, nil
+	}
+
+	indices := lookupIndices(tables, o.Name)
+
+	switch len(indices) {
+	case 0:
+		return 0, fmt.Errorf("unknown object %q", o.Name)
+	case 1:
+		return indices[0], nil
+	default:
+		return 0, fmt.Errorf("object name %q is ambiguous (%v), use its index instead", o.Name, indices)
+	}
+}
+
+func resolveObjectOptions(o *ObjectConfig, tables []*perflib.NameTable) (*collector.ObjectOptions, error) {
+	opts := &collector.ObjectOptions{TotalInstance: o.TotalInstance}
+
+	if len(o.Renames) > 0 {
+		opts.Renames = make(map[uint]string)
+	}
+
+	// Metric names set by the configuration, and what set them
+	metrics := make(map[string]string)
+
+	for ref, name := range o.Renames {
+		if !metricNameRE.MatchString(name) {
+			return nil, fmt.Errorf("invalid metric name %q for counter %s", name, ref)
+		}
+
+		if prev, ok := metrics[name]; ok {
+			return nil, fmt.Errorf("metric name %q is used by both %s and counter %s", name, prev, ref)
+		}
+
+		metrics[name] = "counter " + ref.String()
+
+		indices, err := resolveCounter(ref, tables)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, index := range indices {
+			opts.Renames[index] = name
+		}
+	}
+
+	labels := map[string]bool{"name": true}
+
+	for _, p := range o.PromotedLabels {
+		if err := checkLabel(p.Label, labels); err != nil {
+			return nil, err
+		}
+
+		indices, err := resolveCounter(p.Counter, tables)
+
+		if err != nil {
+			return nil, err
+		}
+
+		opts.PromotedLabels = append(opts.PromotedLabels, collector.PromotedLabel{
+			Label:    p.Label,
+			Counters: indices,
+		})
+	}
+
+	for _, m := range o.MergedLabels {
+		if !metricNameRE.MatchString(m.Metric) {
+			return nil, fmt.Errorf("invalid metric name %q", m.Metric)
+		}
+
+		if prev, ok := metrics[m.Metric]; ok {
+			return nil, fmt.Errorf("metric name %q is used by both %s and a merged metric", m.Metric, prev)
+		}
+
+		metrics[m.Metric] = "a merged metric"
+
+		// Merged labels are only added to the merged metric, so they may repeat
+		// across metrics, but must not clash with the promoted ones
+		if err := checkLabel(m.Label, copyLabels(labels)); err != nil {
+			return nil, err
+		}
+
+		if len(m.Counters) == 0 {
+			return nil, fmt.Errorf("merged metric %q has no counters", m.Metric)
+		}
+
+		merged := collector.MergedLabel{
+			Metric: m.Metric,
+			Label:  m.Label,
+			Values: make(map[uint]string),
+		}
+
+		// Label values of the same metric
+		values := make(map[string]Ref)
+
+		for ref, value := range m.Counters {
+			if prev, ok := values[value]; ok {
+				return nil, fmt.Errorf("counters %s and %s of merged metric %q have the same label value %q", prev, ref, m.Metric, value)
+			}
+
+			values[value] = ref
+
+			indices, err := resolveCounter(ref, tables)
+
+			if err != nil {
+				return nil, err
+			}
+
+			for _, index := range indices {
+				if _, ok := opts.Renames[index]; ok {
+					return nil, fmt.Errorf("counter %s of merged metric %q is also renamed", ref, m.Metric)
+				}
+
+				for _, other := range opts.MergedLabels {
+					if _, ok := other.Values[index]; ok {
+						return nil, fmt.Errorf("counter %s is part of both merged metrics %q and %q", ref, other.Metric, m.Metric)
+					}
+				}
+
+				merged.Values[index] = value
+			}
+		}
+
+		opts.MergedLabels = append(opts.MergedLabels, merged)
+	}
+
+	var err error
+
+	if opts.Include, err = compileAnchored(o.Instances.Include); err != nil {
+		return nil, err
+	}
+
+	if opts.Exclude, err = compileAnchored(o.Instances.Exclude); err != nil {
+		return nil, err
+	}
+
+	return opts, nil
+}
+
+func resolveCounter(ref Ref, tables []*perflib.NameTable) ([]uint, error) {
+	if ref.Name == "" {
+		if !hasIndex(tables, ref.Index) {
+			return nil, fmt.Errorf("unknown counter index %d", ref.Index)
+		}
+
+		return []uint{ref.Index}, nil
+	}
+
+	indices := lookupIndices(tables, ref.Name)
+
+	if len(indices) == 0 {
+		return nil, fmt.Errorf("unknown counter %q", ref.Name)
+	}
+
+	return indices, nil
+}
+
+func checkLabel(label string, seen map[string]bool) error {
+	if !model.LabelName(label).IsValid() {
+		return fmt.Errorf("invalid label name %q", label)
+	}
+
+	if seen[label] {
+		return fmt.Errorf("label %q is used more than once", label)
+	}
+
+	seen[label] = true
+	return nil
+}
+
+func copyLabels(labels map[string]bool) map[string]bool {
+	c := make(map[string]bool, len(labels))
+
+	for k, v := range labels {
+		c[k] = v
+	}
+
+	return c
+}
+
+// Like Prometheus, regular expressions need to match the entire string
+func compileAnchored(expressions []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+
+	for _, expr := range expressions {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid instance filter %q: %v", expr, err)
+		}
+
+		compiled = append(compiled, re)
+	}
+
+	return compiled, nil
+}
+
+func hasIndex(tables []*perflib.NameTable, index uint) bool {
+	for _, t := range tables {
+		if t.LookupString(uint32(index)) != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Indices with the given name in any of the tables, in ascending order
+func lookupIndices(tables []*perflib.NameTable, name string) []uint {
+	seen := make(map[uint]bool)
+
+	for _, t := range tables {
+		for _, index := range t.LookupIndices(name) {
+			seen[uint(index)] = true
+		}
+	}
+
+	indices := make([]uint, 0, len(seen))
+
+	for index := range seen {
+		indices = append(indices, index)
+	}
+
+	sort.Slice(indices, func(i, j int) bool {
+		return indices[i] < indices[j]
+	})
+
+	return indices
+}
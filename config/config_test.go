@@ -0,0 +1,241 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/leoluk/perflib_exporter/collector"
+	"github.com/leoluk/perflib_exporter/perflib"
+	"github.com/leoluk/perflib_exporter/perflib/perflibtest"
+)
+
+var testNames = perflib.NewNameTable(map[uint32]string{
+	230:  "Process",
+	238:  "Processor",
+	142:  "% User Time",
+	144:  "% Privileged Time",
+	180:  "Working Set",
+	784:  "ID Process",
+	1410: "Creating Process ID",
+	// Shared by several objects
+	6:    "% Processor Time",
+	1000: "% Processor Time",
+	// Two objects with the same name
+	5000: "Duplicate",
+	5002: "Duplicate",
+})
+
+const testConfig = `
+objects:
+  - name: Process
+    renames:
+      Working Set: working_set_bytes
+    promoted_labels:
+      - label: process_id
+        counter: ID Process
+      - label: creating_process_id
+        counter: 1410
+    merged_labels:
+      - metric: processor_time_total
+        label: mode
+        counters:
+          "% User Time": user
+          "% Privileged Time": privileged
+    instances:
+      exclude: [Idle, "svchost#\\d+"]
+    totals: drop
+
+  - index: 238
+    renames:
+      "% Processor Time": time_total
+    instances:
+      include: ["\\d+"]
+    totals: aggregate
+    total_instance: Total
+`
+
+func TestResolve(t *testing.T) {
+	c, err := Parse([]byte(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := c.Resolve(nil, testNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.Objects) != 2 || r.Objects[0] != 230 || r.Objects[1] != 238 {
+		t.Errorf("unexpected objects %v", r.Objects)
+	}
+
+	process := r.ObjectOptions[230]
+
+	if process.Renames[180] != "working_set_bytes" {
+		t.Errorf("unexpected renames %v", process.Renames)
+	}
+
+	if len(process.PromotedLabels) != 2 ||
+		process.PromotedLabels[0].Label != "process_id" || process.PromotedLabels[0].Counters[0] != 784 ||
+		process.PromotedLabels[1].Label != "creating_process_id" || process.PromotedLabels[1].Counters[0] != 1410 {
+		t.Errorf("unexpected promoted labels %+v", process.PromotedLabels)
+	}
+
+	if len(process.MergedLabels) != 1 || process.MergedLabels[0].Values[142] != "user" || process.MergedLabels[0].Values[144] != "privileged" {
+		t.Errorf("unexpected merged labels %+v", process.MergedLabels)
+	}
+
+	for instance, excluded := range map[string]bool{"Idle": true, "svchost#12": true, "svchost": false, "Idle2": false} {
+		matched := false
+		for _, re := range process.Exclude {
+			matched = matched || re.MatchString(instance)
+		}
+		if matched != excluded {
+			t.Errorf("%s: expected excluded to be %v", instance, excluded)
+		}
+	}
+
+	// Counter names may refer to several counters
+	if processor := r.ObjectOptions[238]; len(processor.Renames) != 2 || processor.Renames[6] != "time_total" || processor.Renames[1000] != "time_total" {
+		t.Errorf("unexpected renames %v", processor.Renames)
+	}
+
+	if r.ObjectOptions[238].TotalInstance != "Total" || r.ObjectOptions[230].TotalInstance != "" {
+		t.Errorf("unexpected total instances %q, %q", r.ObjectOptions[238].TotalInstance, r.ObjectOptions[230].TotalInstance)
+	}
+
+	if r.ObjectTotalPolicies[230] != collector.TotalDrop || r.ObjectTotalPolicies[238] != collector.TotalAggregate {
+		t.Errorf("unexpected total policies %v", r.ObjectTotalPolicies)
+	}
+}
+
+func TestResolveLocalized(t *testing.T) {
+	german := perflib.NewNameTable(map[uint32]string{230: "Prozess", 784: "Prozesskennung"})
+
+	c, err := Parse([]byte(`
+objects:
+  - name: Prozess
+    promoted_labels:
+      - {label: process_id, counter: Prozesskennung}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := c.Resolve(nil, testNames, german)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.Objects) != 1 || r.Objects[0] != 230 || r.ObjectOptions[230].PromotedLabels[0].Counters[0] != 784 {
+		t.Errorf("unexpected resolved configuration %+v", r)
+	}
+}
+
+// A Process object with counters of different types, named using testNames
+func processSnapshot(t *testing.T) *perflib.Snapshot {
+	b := perflibtest.New()
+
+	process := b.AddObject(230)
+	process.AddCounter(142, collector.PERF_100NSEC_TIMER, 8)
+	process.AddCounter(144, collector.PERF_100NSEC_TIMER, 8)
+	process.AddCounter(180, collector.PERF_COUNTER_LARGE_RAWCOUNT, 8)
+	process.AddCounter(784, collector.PERF_COUNTER_HISTOGRAM_TYPE, 4)
+	process.AddInstance("svchost", 1, 2, 3, 4)
+
+	snapshot, err := perflib.ParseSnapshot(b.Bytes(), testNames, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return snapshot
+}
+
+func TestResolveMergedTypes(t *testing.T) {
+	source := &perflib.FakeSource{Snapshots: map[string]*perflib.Snapshot{"": processSnapshot(t)}}
+
+	for _, tc := range []struct {
+		counters string
+		valid    bool
+	}{
+		{`{142: user, 144: privileged}`, true},
+		// Unsupported counters are dropped by the collector
+		{`{142: user, 784: id}`, true},
+		{`{142: user, 180: working_set}`, false},
+	} {
+		c, err := Parse([]byte(`objects: [{index: 238}, {index: 230, merged_labels: [{metric: time, label: mode, counters: ` + tc.counters + `}]}]`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = c.Resolve(source, testNames)
+		if tc.valid && err != nil {
+			t.Errorf("%s: %v", tc.counters, err)
+		}
+		if !tc.valid && (err == nil || !strings.Contains(err.Error(), "objects[1] (230): counters of merged metric \"time\" have different types")) {
+			t.Errorf("%s: expected a type mismatch, got %v", tc.counters, err)
+		}
+	}
+
+	if q := source.Queries(); len(q) != 3 || q[0] != "230" {
+		t.Errorf("expected only objects with renames or merged labels to be queried, got %v", q)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []string{
+		`objects: [{name: Process, unknown: 1}]`,
+		`objects: [{name: Process, promoted_labels: [{label: pid, counter: [1]}]}]`,
+		`objects: {}`,
+	} {
+		if _, err := Parse([]byte(tc)); err == nil {
+			t.Errorf("%s: expected an error", tc)
+		}
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	source := &perflib.FakeSource{Snapshots: map[string]*perflib.Snapshot{"": processSnapshot(t)}}
+
+	for _, tc := range []struct {
+		config string
+		err    string
+	}{
+		{`objects: [{}]`, "exactly one of index and name"},
+		{`objects: [{index: 230, name: Process}]`, "exactly one of index and name"},
+		{`objects: [{name: Nope}]`, `unknown object "Nope"`},
+		{`objects: [{index: 9999}]`, "unknown object index 9999"},
+		{`objects: [{name: Duplicate}]`, "ambiguous"},
+		{`objects: [{index: 230}, {name: Process}]`, "objects[1]: object 230 is listed more than once"},
+		{`objects: [{index: 230, renames: {Nope: foo}}]`, `unknown counter "Nope"`},
+		{`objects: [{index: 230, renames: {9999: foo}}]`, "unknown counter index 9999"},
+		{`objects: [{index: 230, renames: {180: working-set}}]`, "invalid metric name"},
+		{`objects: [{index: 230, promoted_labels: [{label: name, counter: 784}]}]`, `label "name" is used more than once`},
+		{`objects: [{index: 230, promoted_labels: [{label: pid, counter: 784}, {label: pid, counter: 1410}]}]`, `label "pid" is used more than once`},
+		{`objects: [{index: 230, promoted_labels: [{label: "1pid", counter: 784}]}]`, "invalid label name"},
+		{`objects: [{index: 230, merged_labels: [{metric: time, label: mode}]}]`, "has no counters"},
+		{`objects: [{index: 230, merged_labels: [{metric: time, label: pid, counters: {142: user}}], promoted_labels: [{label: pid, counter: 784}]}]`, `label "pid" is used more than once`},
+		{`objects: [{index: 230, instances: {include: ["("]}}]`, "invalid instance filter"},
+		{`objects: [{index: 230, totals: sum}]`, "sum"},
+		{`objects: [{index: 230, renames: {142: time, 144: time}}]`, `metric name "time" is used by both`},
+		{`objects: [{index: 230, renames: {180: time}, merged_labels: [{metric: time, label: mode, counters: {142: user}}]}]`, `metric name "time" is used by both counter 180 and a merged metric`},
+		{`objects: [{index: 230, merged_labels: [{metric: time, label: mode, counters: {142: user}}, {metric: time, label: kind, counters: {144: privileged}}]}]`, `metric name "time" is used by both a merged metric and a merged metric`},
+		{`objects: [{index: 230, renames: {142: user_time}, merged_labels: [{metric: time, label: mode, counters: {142: user}}]}]`, "is also renamed"},
+		{`objects: [{index: 230, merged_labels: [{metric: time, label: mode, counters: {142: user}}, {metric: cpu, label: mode, counters: {142: user}}]}]`, `part of both merged metrics "time" and "cpu"`},
+		{`objects: [{index: 230, merged_labels: [{metric: time, label: mode, counters: {142: user, 144: user}}]}]`, `have the same label value "user"`},
+		// Checked against the counters of the object
+		{`objects: [{index: 230, renames: {142: working_set}}]`, `objects[0] (230): metric name "working_set" collides with the name of counter 180 ("Working Set")`},
+		{`objects: [{index: 230, merged_labels: [{metric: working_set, label: mode, counters: {142: user}}]}]`, `metric name "working_set" collides`},
+		{`objects: [{index: 230, renames: {180: user_time_total}}]`, `metric name "user_time_total" collides with the name of counter 142`},
+	} {
+		c, err := Parse([]byte(tc.config))
+		if err != nil {
+			t.Errorf("%s: %v", tc.config, err)
+			continue
+		}
+
+		if _, err := c.Resolve(source, testNames); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected an error containing %q, got %v", tc.config, tc.err, err)
+		}
+	}
+}
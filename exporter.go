@@ -23,6 +23,7 @@ import (
 	"gopkg.in/alecthomas/kingpin.v2"
 
 	"github.com/leoluk/perflib_exporter/collector"
+	"github.com/leoluk/perflib_exporter/config"
 	"github.com/leoluk/perflib_exporter/perflib"
 )
 
@@ -102,6 +103,7 @@ func execute(logger log.Logger, name string, c collector.Collector, ch chan<- pr
 
 // Make sure we crash instead of consuming inappropriate amounts of memory
 // There's no easy way to set a memory limit on Windows.
+// Query buffers are capped well below the limit (see perflib's maxRawDataSize).
 func initMemoryGuard(l log.Logger) {
 	go func() {
 		for {
@@ -156,8 +158,25 @@ var defaultPerflibObjects = []uint32{
 var (
 	defaultQuery string
 	authTokens   *[]string
+
+	// Where performance data comes from (the registry, unless replaying a capture).
+	// Shared between scrapes and /dump, which may run concurrently.
+	source perflib.Source = perflib.NewClient(nil)
+
+	// Name tables for --perflib.language. Metric names are always derived from
+	// the English names; these are only used for matching object names and on /dump.
+	localCounterNames *perflib.NameTable
+	localHelpNames    *perflib.NameTable
+
+	// Used by /dump to show the labels configured for an object
+	perflibCollector *collector.PerflibCollector
 )
 
+// Sources which resolve names using tables we can validate the configuration file against
+type nameTableSource interface {
+	NameTables() (counterNames, helpNames *perflib.NameTable, err error)
+}
+
 func main() {
 	var (
 		listenAddress = kingpin.Flag(
@@ -177,6 +196,16 @@ func main() {
 			"perflib.objects.names.add", "List of perflib object names to add to list").Strings()
 		perfObjectsNamesRemove = kingpin.Flag(
 			"perflib.objects.names.remove", "List of perflib object names to remove from list").Strings()
+		language = kingpin.Flag(
+			"perflib.language", "Language ID of the object names accepted by the perflib.objects.names flags (in addition to English) and of help texts on /dump, e.g. 007 for German or CurrentLanguage").Default("009").String()
+		totalPolicy = kingpin.Flag(
+			"perflib.totals", "How to export total instances like _Total: drop, keep (as regular instance) or aggregate (_Total as separate _aggregate metrics)").Default("drop").Enum("drop", "keep", "aggregate")
+		objectTotalPolicies = kingpin.Flag(
+			"perflib.totals.objects", "Total policy for individual objects, as object index=policy (e.g. 4674=aggregate)").StringMap()
+		configFile = kingpin.Flag(
+			"config.file", "YAML file selecting objects and configuring metric names, labels and instance filters for them").String()
+		replayPath = kingpin.Flag(
+			"perflib.replay", "Serve data from a capture file instead of querying the registry").String()
 	)
 
 	authTokens = kingpin.Flag(
@@ -211,17 +240,57 @@ func main() {
 	prometheus.MustRegister(version.NewCollector("perflib_exporter"))
 	initMemoryGuard(logger)
 
+	if *replayPath != "" {
+		captureSource, err := perflib.NewCaptureFileSource(*replayPath)
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to read capture file", "err", err)
+			os.Exit(1)
+		}
+
+		capture := captureSource.Capture()
+		level.Info(logger).Log("msg", "replaying capture", "path", *replayPath, "query", capture.Query, "time", capture.Time)
+		source = captureSource
+	}
+
+	if *language != "009" {
+		if *replayPath != "" {
+			// Captures only contain the English name tables
+			level.Warn(logger).Log("msg", "ignoring perflib.language when replaying a capture", "language", *language)
+		} else {
+			var err error
+			localCounterNames, localHelpNames, err = perflib.QueryLanguageNameTables(*language)
+			if err != nil {
+				level.Error(logger).Log("msg", "failed to load name tables", "language", *language, "err", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	var cfg *config.Resolved
+	if *configFile != "" {
+		var err error
+		cfg, err = loadConfig(*configFile)
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to load configuration file", "path", *configFile, "err", err)
+			os.Exit(1)
+		}
+
+		for _, index := range cfg.Objects {
+			*perfObjects = append(*perfObjects, uint32(index))
+		}
+	}
+
 	// Prepare perflib queryBuf
 	var queryBuf bytes.Buffer
 
 	// Get all existing objects if one of the perflib.objects.names flags was used
 	var objects []*perflib.PerfObject
 	if len(*perfObjectsNames) > 0 || len(*perfObjectsNamesAdd) > 0 || len(*perfObjectsNamesRemove) > 0 {
-		o, err := perflib.QueryPerformanceData("Global")
+		snapshot, err := source.Query("Global")
 		if err != nil {
 			panic(err)
 		}
-		objects = o
+		objects = snapshot.Objects
 	}
 
 	*perfObjects = append(*perfObjects, objectNamesToIndices(perfObjectsNames, objects)...)
@@ -263,9 +332,38 @@ loopPerfObjects:
 		go svc.Run(serviceName, &perflibExporterService{stopCh: stopCh, logger: logger})
 	}
 
+	collectorOptions := collector.Options{
+		TotalPolicy:         collector.TotalPolicy(*totalPolicy),
+		ObjectTotalPolicies: make(map[uint]collector.TotalPolicy),
+	}
+
+	// Flags take precedence over the configuration file
+	if cfg != nil {
+		collectorOptions.Objects = cfg.ObjectOptions
+
+		for index, policy := range cfg.ObjectTotalPolicies {
+			collectorOptions.ObjectTotalPolicies[index] = policy
+		}
+	}
+
+	for object, policy := range *objectTotalPolicies {
+		index, err := strconv.ParseUint(object, 10, 32)
+		if err != nil {
+			level.Error(logger).Log("msg", "invalid object index in perflib.totals.objects", "object", object)
+			os.Exit(1)
+		}
+
+		collectorOptions.ObjectTotalPolicies[uint(index)], err = collector.ParseTotalPolicy(policy)
+		if err != nil {
+			level.Error(logger).Log("msg", "invalid perflib.totals.objects", "object", object, "err", err)
+			os.Exit(1)
+		}
+	}
+
 	// Initialize the exporter
+	perflibCollector = collector.NewPerflibCollectorWithOptions(logger, source, defaultQuery, collectorOptions)
 	nodeCollector := PerflibExporter{collectors: map[string]collector.Collector{
-		"perflib": collector.NewPerflibCollector(logger, defaultQuery),
+		"perflib": perflibCollector,
 	}, logger: logger}
 
 	prometheus.MustRegister(nodeCollector)
@@ -292,12 +390,13 @@ loopPerfObjects:
 	}
 }
 
-// objectNamesToIndices converts a slice of perflib object Name values to a slice of perflib NameIndex values
+// objectNamesToIndices converts a slice of perflib object Name values to a slice of perflib NameIndex values.
+// Names may be given in English or in the language selected by --perflib.language.
 func objectNamesToIndices(names *[]string, objectDefinitions []*perflib.PerfObject) (indices []uint32) {
 outerloop:
 	for _, p := range *names {
 		for _, o := range objectDefinitions {
-			if p == o.Name {
+			if p == o.Name || p == localCounterNames.LookupString(uint32(o.NameIndex)) {
 				indices = append(indices, uint32(o.NameIndex))
 				continue outerloop
 			}
@@ -307,6 +406,28 @@ outerloop:
 	return indices
 }
 
+// loadConfig loads the configuration file and resolves its names against the
+// name tables of the source, as well as the ones for --perflib.language.
+func loadConfig(path string) (*config.Resolved, error) {
+	cfg, err := config.Load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := []*perflib.NameTable{localCounterNames}
+
+	if s, ok := source.(nameTableSource); ok {
+		counterNames, _, err := s.NameTables()
+		if err != nil {
+			return nil, err
+		}
+
+		tables = append(tables, counterNames)
+	}
+
+	return cfg.Resolve(source, tables...)
+}
+
 func healthCheck(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	io.WriteString(w, `{"status":"ok"}`)
@@ -6,8 +6,10 @@ require (
 	github.com/davecgh/go-spew v1.1.1
 	github.com/go-kit/log v0.1.0
 	github.com/prometheus/client_golang v1.11.0
+	github.com/prometheus/client_model v0.2.0
 	github.com/prometheus/common v0.31.1
 	golang.org/x/sys v0.0.0-20210603081109-ebe580a85c40
 	google.golang.org/appengine v1.6.6 // indirect
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,232 @@
+package perflib
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	// Default upper limit for a single query result. Global queries on large
+	// machines return a few megabytes; anything beyond this is treated as an
+	// error rather than growing the buffer forever.
+	//
+	// While growing, both the old and the doubled buffer are alive, so a query
+	// may briefly hold 1.5 times this much. This needs to stay well below the
+	// exporter's memory guard (250 MB, see initMemoryGuard), so the cap fires
+	// before the process gets killed.
+	maxRawDataSize = 64 << 20
+
+	// Number of distinct queries whose sizes and buffers are remembered. Queries
+	// can be user-provided (see /dump), so this needs to be bounded.
+	maxPooledQueries = 64
+
+	// Smallest buffer handed to RegQueryValueEx
+	minRawDataSize = 16384
+
+	// Number of idle buffers kept per query. Scrapes are usually sequential,
+	// so one is enough to avoid allocations in the common case.
+	maxIdleBuffers = 2
+
+	// Upper limit for the total size of idle buffers across all queries. When
+	// it's exceeded, buffers of the least recently used queries are dropped.
+	maxIdleBytes = 32 << 20
+)
+
+/*
+Buffers for queryRawData, pooled per query. RegQueryValueEx doesn't report the
+required size for HKEY_PERFORMANCE_DATA, so the pool also remembers how large
+the result of each query was, to get it right the first time on the next call.
+*/
+type bufferPool struct {
+	mu      sync.Mutex
+	queries map[string]*pooledQuery
+	maxSize int
+
+	// Total capacity of all idle buffers, bounded by maxIdleBytes
+	idleBytes    int
+	maxIdleBytes int
+
+	// Incremented on every use, to find the least recently used query
+	clock uint64
+}
+
+type pooledQuery struct {
+	// Size of the largest result seen so far, 0 if there was none yet
+	size int
+	idle [][]byte
+	used uint64
+}
+
+func newBufferPool() *bufferPool {
+	return &bufferPool{
+		queries:      make(map[string]*pooledQuery),
+		maxSize:      maxRawDataSize,
+		maxIdleBytes: maxIdleBytes,
+	}
+}
+
+// Used by the package-level query functions. Clients have their own pool.
+var rawDataBuffers = newBufferPool()
+
+// Initial buffer size for queries without a remembered size
+func estimateBufferSize(query string) int {
+	switch query {
+	case "Global":
+		return 400000
+	case "Costly":
+		return 2000000
+	default:
+		// Depends on the number of objects requested, this is an educated guess
+		return 150000 * len(strings.Fields(query))
+	}
+}
+
+// Return a buffer for query, with its length set to the full capacity.
+func (p *bufferPool) get(query string) []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var size int
+
+	if q, ok := p.queries[query]; ok && q.size > 0 {
+		p.touch(q)
+
+		if n := len(q.idle); n > 0 {
+			buffer := q.idle[n-1]
+			q.idle = q.idle[:n-1]
+			p.idleBytes -= cap(buffer)
+			return buffer[:cap(buffer)]
+		}
+
+		// Leave some headroom, since results tend to grow (new processes etc.)
+		size = q.size + q.size/8
+	} else {
+		size = estimateBufferSize(query)
+	}
+
+	if size < minRawDataSize {
+		size = minRawDataSize
+	} else if size > p.maxSize {
+		size = p.maxSize
+	}
+
+	return make([]byte, size)
+}
+
+// Return a larger buffer, after RegQueryValueEx reported ERROR_MORE_DATA. The
+// contents of the old buffer aren't preserved.
+func (p *bufferPool) grow(buffer []byte) ([]byte, error) {
+	if len(buffer) >= p.maxSize {
+		return nil, fmt.Errorf("perflib: query result exceeds %d bytes", p.maxSize)
+	}
+
+	size := len(buffer) * 2
+
+	if size < minRawDataSize {
+		size = minRawDataSize
+	}
+
+	if size > p.maxSize {
+		size = p.maxSize
+	}
+
+	return make([]byte, size), nil
+}
+
+// Remember the size of a successful query result.
+func (p *bufferPool) done(query string, size int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	q := p.lookup(query)
+
+	if q == nil {
+		return
+	}
+
+	p.touch(q)
+
+	if size > q.size {
+		q.size = size
+	}
+}
+
+/*
+Make a buffer returned by get or grow available for reuse. It must not be
+referenced afterwards.
+
+Only buffers of queries with a known result size are kept, and only if they fit
+that size: a buffer grown for a single large result would otherwise stay
+allocated for good.
+*/
+func (p *bufferPool) put(query string, buffer []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	q, ok := p.queries[query]
+
+	if !ok || q.size == 0 || len(q.idle) >= maxIdleBuffers {
+		return
+	}
+
+	if size := cap(buffer); size < q.size || size > 2*q.size || size > p.maxIdleBytes {
+		return
+	}
+
+	p.evict(p.maxIdleBytes - cap(buffer))
+
+	q.idle = append(q.idle, buffer)
+	p.idleBytes += cap(buffer)
+}
+
+// Drop idle buffers of the least recently used queries until at most limit
+// bytes remain. Must be called with mu held.
+func (p *bufferPool) evict(limit int) {
+	for p.idleBytes > limit {
+		var oldest *pooledQuery
+
+		for _, q := range p.queries {
+			if len(q.idle) > 0 && (oldest == nil || q.used < oldest.used) {
+				oldest = q
+			}
+		}
+
+		p.idleBytes -= cap(oldest.idle[0])
+		oldest.idle[0] = nil
+		oldest.idle = oldest.idle[1:]
+	}
+}
+
+// Mark q as used. Must be called with mu held.
+func (p *bufferPool) touch(q *pooledQuery) {
+	p.clock++
+	q.used = p.clock
+}
+
+// Must be called with mu held. Returns nil if the pool is full.
+func (p *bufferPool) lookup(query string) *pooledQuery {
+	q, ok := p.queries[query]
+
+	if !ok {
+		if len(p.queries) >= maxPooledQueries {
+			return nil
+		}
+
+		q = new(pooledQuery)
+		p.queries[query] = q
+	}
+
+	return q
+}
+
+// Query HKEY_PERFORMANCE_DATA using the package-wide pool.
+func queryRawData(query string) ([]byte, error) {
+	return rawDataBuffers.queryRegistry(query)
+}
+
+// Hand a buffer returned by queryRawData back for reuse, once nothing refers to
+// it anymore (parsing copies everything it needs).
+func releaseRawData(query string, buffer []byte) {
+	rawDataBuffers.put(query, buffer)
+}
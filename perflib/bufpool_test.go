@@ -0,0 +1,125 @@
+package perflib
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	p := newBufferPool()
+
+	if n := len(p.get("Global")); n != 400000 {
+		t.Errorf("expected the default size for Global, got %d", n)
+	}
+	if n := len(p.get("238 2 5")); n != 3*150000 {
+		t.Errorf("expected an estimate based on the number of objects, got %d", n)
+	}
+	if n := len(p.get("")); n != minRawDataSize {
+		t.Errorf("expected the minimum size for an empty query, got %d", n)
+	}
+
+	// Sizes are remembered for any query
+	p.done("238", 1000000)
+
+	buffer := p.get("238")
+	if len(buffer) < 1000000 {
+		t.Fatalf("expected at least the remembered size, got %d", len(buffer))
+	}
+
+	// Returned buffers are reused
+	p.put("238", buffer[:10])
+
+	if reused := p.get("238"); &reused[0] != &buffer[0] || len(reused) != len(buffer) {
+		t.Error("expected the released buffer to be reused at full length")
+	}
+	if fresh := p.get("238"); &fresh[0] == &buffer[0] {
+		t.Error("a buffer must not be handed out twice")
+	}
+
+	// Buffers smaller than the remembered size aren't kept
+	p.put("238", make([]byte, 100))
+
+	if n := len(p.get("238")); n < 1000000 {
+		t.Errorf("expected a buffer of the remembered size, got %d", n)
+	}
+}
+
+func TestBufferPoolGrow(t *testing.T) {
+	p := newBufferPool()
+	p.maxSize = 300000
+
+	buffer, err := p.grow(make([]byte, 100000))
+	if err != nil || len(buffer) != 200000 {
+		t.Errorf("expected the buffer to double, got %d (%v)", len(buffer), err)
+	}
+
+	buffer, err = p.grow(buffer)
+	if err != nil || len(buffer) != p.maxSize {
+		t.Errorf("expected the buffer to be capped, got %d (%v)", len(buffer), err)
+	}
+
+	if _, err := p.grow(buffer); err == nil {
+		t.Error("expected an error when growing beyond the cap")
+	}
+}
+
+func TestBufferPoolLimit(t *testing.T) {
+	p := newBufferPool()
+
+	for i := 0; i < maxPooledQueries*2; i++ {
+		p.done(strconv.Itoa(i), 1000000)
+	}
+
+	if len(p.queries) != maxPooledQueries {
+		t.Errorf("expected %d remembered queries, got %d", maxPooledQueries, len(p.queries))
+	}
+
+	// Queries beyond the limit fall back to the estimate
+	if n := len(p.get(strconv.Itoa(maxPooledQueries))); n != 150000 {
+		t.Errorf("expected the estimated size, got %d", n)
+	}
+}
+
+func TestBufferPoolOversized(t *testing.T) {
+	p := newBufferPool()
+	p.done("238", 100000)
+
+	// A buffer grown for a single large result isn't kept
+	p.put("238", make([]byte, 10000000))
+
+	if len(p.queries["238"].idle) != 0 || p.idleBytes != 0 {
+		t.Error("expected the oversized buffer to be dropped")
+	}
+	if n := len(p.get("238")); n > 200000 {
+		t.Errorf("expected a buffer of the remembered size, got %d", n)
+	}
+
+	// Neither are buffers of queries without a known size
+	p.put("230", make([]byte, 100000))
+
+	if _, ok := p.queries["230"]; ok || p.idleBytes != 0 {
+		t.Error("expected the buffer of an unknown query to be dropped")
+	}
+}
+
+func TestBufferPoolIdleBytes(t *testing.T) {
+	p := newBufferPool()
+	p.maxIdleBytes = 250000
+
+	for _, query := range []string{"230", "238", "2"} {
+		p.done(query, 100000)
+		p.put(query, p.get(query))
+	}
+
+	if p.idleBytes > p.maxIdleBytes {
+		t.Errorf("expected at most %d idle bytes, got %d", p.maxIdleBytes, p.idleBytes)
+	}
+
+	// The least recently used query lost its buffer
+	if len(p.queries["230"].idle) != 0 {
+		t.Error("expected the oldest buffer to be evicted")
+	}
+	if len(p.queries["238"].idle) != 1 || len(p.queries["2"].idle) != 1 {
+		t.Error("expected the recent buffers to be kept")
+	}
+}
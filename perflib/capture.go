@@ -0,0 +1,207 @@
+package perflib
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+/*
+A Capture is a recording of a raw query result, along with the name tables
+needed to resolve it. Captures can be written to a file on a Windows machine
+and replayed anywhere else, yielding the same objects as the original query.
+
+File format (all integers little endian):
+
+	[8]byte  magic ("PERFCAPT")
+	uint32   format version (1)
+	int64    capture time (unix nanoseconds)
+	4 times: uint32 length followed by the data:
+	         query string (UTF-8), raw PERF_DATA_BLOCK,
+	         raw "Counter 009" name table, raw "Help 009" name table
+*/
+type Capture struct {
+	Time  time.Time
+	Query string
+
+	// Raw buffer returned by RegQueryValueEx
+	Data []byte
+
+	// Raw name tables, as returned by RegQueryValueEx for "Counter 009" and "Help 009"
+	CounterNames []byte
+	HelpNames    []byte
+}
+
+const captureVersion = 1
+
+var captureMagic = [8]byte{'P', 'E', 'R', 'F', 'C', 'A', 'P', 'T'}
+
+// Upper limit for a single section, to avoid huge allocations when reading garbage
+const maxCaptureSectionLength = 1 << 30
+
+// Query the registry and record the raw result, along with the English name tables.
+func CaptureQuery(query string) (*Capture, error) {
+	c := &Capture{Time: time.Now(), Query: query}
+
+	for _, s := range []struct {
+		name string
+		dst  *[]byte
+	}{
+		{query, &c.Data},
+		{"Counter 009", &c.CounterNames},
+		{"Help 009", &c.HelpNames},
+	} {
+		buffer, err := queryRawData(s.name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		*s.dst = buffer
+	}
+
+	return c, nil
+}
+
+// Write the capture in the format described above.
+func (c *Capture) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{w: bw}
+
+	header := struct {
+		Magic   [8]byte
+		Version uint32
+		Time    int64
+	}{captureMagic, captureVersion, c.Time.UnixNano()}
+
+	err := binary.Write(cw, binary.LittleEndian, &header)
+
+	if err != nil {
+		return cw.n, err
+	}
+
+	for _, section := range [][]byte{[]byte(c.Query), c.Data, c.CounterNames, c.HelpNames} {
+		err = binary.Write(cw, binary.LittleEndian, uint32(len(section)))
+
+		if err != nil {
+			return cw.n, err
+		}
+
+		_, err = cw.Write(section)
+
+		if err != nil {
+			return cw.n, err
+		}
+	}
+
+	return cw.n, bw.Flush()
+}
+
+// Read a capture written by WriteTo.
+func ReadCapture(r io.Reader) (*Capture, error) {
+	var header struct {
+		Magic   [8]byte
+		Version uint32
+		Time    int64
+	}
+
+	err := binary.Read(r, binary.LittleEndian, &header)
+
+	if err != nil {
+		return nil, fmt.Errorf("perflib: failed to read capture header: %v", err)
+	}
+
+	if header.Magic != captureMagic {
+		return nil, errors.New("perflib: not a capture file")
+	}
+
+	if header.Version != captureVersion {
+		return nil, fmt.Errorf("perflib: unsupported capture version %d", header.Version)
+	}
+
+	sections := make([][]byte, 4)
+
+	for i := range sections {
+		var length uint32
+		err = binary.Read(r, binary.LittleEndian, &length)
+
+		if err != nil {
+			return nil, fmt.Errorf("perflib: failed to read capture: %v", err)
+		}
+
+		if length > maxCaptureSectionLength {
+			return nil, fmt.Errorf("perflib: capture section too large (%d bytes)", length)
+		}
+
+		sections[i] = make([]byte, length)
+		_, err = io.ReadFull(r, sections[i])
+
+		if err != nil {
+			return nil, fmt.Errorf("perflib: failed to read capture: %v", err)
+		}
+	}
+
+	return &Capture{
+		Time:         time.Unix(0, header.Time),
+		Query:        string(sections[0]),
+		Data:         sections[1],
+		CounterNames: sections[2],
+		HelpNames:    sections[3],
+	}, nil
+}
+
+// Convenience wrapper around ReadCapture.
+func ReadCaptureFile(path string) (*Capture, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return ReadCapture(bufio.NewReader(f))
+}
+
+// Name tables stored in the capture.
+func (c *Capture) NameTables() (counterNames, helpNames *NameTable, err error) {
+	counterNames, err = ParseNameTable(c.CounterNames)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	helpNames, err = ParseNameTable(c.HelpNames)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return counterNames, helpNames, nil
+}
+
+// Parse the captured data, resolving names using the captured name tables.
+func (c *Capture) Parse() (*Snapshot, error) {
+	counterNames, helpNames, err := c.NameTables()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseSnapshot(c.Data, counterNames, helpNames)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,81 @@
+package perflib
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/leoluk/perflib_exporter/perflib/perflibtest"
+)
+
+func TestCaptureRoundTrip(t *testing.T) {
+	b := perflibtest.New()
+	object := b.AddObject(230)
+	object.AddCounter(784, 0x00010000, 4)
+	object.AddInstance("svchost", 928)
+
+	capture := &Capture{
+		Time:         time.Unix(1517177880, 0),
+		Query:        "2 230",
+		Data:         b.Bytes(),
+		CounterNames: perflibtest.NameTable(map[uint32]string{230: "Process", 784: "ID Process"}),
+		HelpNames:    perflibtest.NameTable(map[uint32]string{231: "The Process performance object"}),
+	}
+
+	w := new(bytes.Buffer)
+	n, err := capture.WriteTo(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(w.Len()) {
+		t.Errorf("WriteTo reported %d bytes, wrote %d", n, w.Len())
+	}
+
+	replayed, err := ReadCapture(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(capture, replayed) {
+		t.Fatalf("capture changed after round trip: %+v", replayed)
+	}
+
+	snapshot, err := replayed.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counterNames, helpNames, err := capture.NameTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, objects, err := ParsePerformanceData(capture.Data, counterNames, helpNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(snapshot.Objects, objects) {
+		t.Error("replayed objects differ from the original ones")
+	}
+
+	process := snapshot.Objects[0]
+	if process.Name != "Process" || process.HelpText != "The Process performance object" ||
+		process.Instances[0].Counters[0].Def.Name != "ID Process" {
+		t.Errorf("names were not resolved: %q %q", process.Name, process.HelpText)
+	}
+}
+
+func TestReadCaptureInvalid(t *testing.T) {
+	if _, err := ReadCapture(bytes.NewReader([]byte("PERFCAPX\x01\x00\x00\x00"))); err == nil {
+		t.Error("expected an error for an invalid magic")
+	}
+
+	b := new(bytes.Buffer)
+	(&Capture{Query: "Global", Data: []byte{1, 2, 3}}).WriteTo(b)
+
+	if _, err := ReadCapture(bytes.NewReader(b.Bytes()[:b.Len()-1])); err == nil {
+		t.Error("expected an error for a truncated capture")
+	}
+}
@@ -0,0 +1,97 @@
+package perflib
+
+import (
+	"fmt"
+	"sync"
+)
+
+/*
+A Client queries performance data, like QuerySnapshot. Unlike the package-level
+functions, it keeps its own name tables and buffers, so independent consumers
+don't share any state.
+
+A Client is safe for concurrent use and implements Source.
+*/
+type Client struct {
+	options Options
+	buffers *bufferPool
+
+	// Returns a raw buffer for a query, using buffers. Defaults to querying
+	// HKEY_PERFORMANCE_DATA; replaced in tests.
+	queryRaw func(buffers *bufferPool, query string) ([]byte, error)
+
+	// Name tables, loaded on first use unless set in options
+	mu           sync.Mutex
+	counterNames *NameTable
+	helpNames    *NameTable
+}
+
+// Create a client. opts may be nil, in which case names are resolved using the
+// English name tables (see Options).
+func NewClient(opts *Options) *Client {
+	c := &Client{
+		buffers:  newBufferPool(),
+		queryRaw: (*bufferPool).queryRegistry,
+	}
+
+	if opts != nil {
+		c.options = *opts
+	}
+
+	return c
+}
+
+// Query performance data. See QueryPerformanceData for the query syntax.
+func (c *Client) Query(query string) (*Snapshot, error) {
+	buffer, err := c.queryRaw(c.buffers, query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The buffer is only used for parsing, so it can be reused right away
+	defer c.buffers.put(query, buffer)
+
+	counterNames, helpNames, err := c.NameTables()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseSnapshot(buffer, counterNames, helpNames)
+}
+
+// Return the name tables used to resolve names, loading them if necessary.
+// helpNames is nil if the client was created with SkipHelpTexts.
+func (c *Client) NameTables() (counterNames, helpNames *NameTable, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counterNames == nil {
+		if c.options.CounterNames != nil {
+			c.counterNames = c.options.CounterNames
+		} else if c.counterNames, err = c.loadNameTable("Counter 009"); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if c.helpNames == nil && !c.options.SkipHelpTexts {
+		if c.options.HelpNames != nil {
+			c.helpNames = c.options.HelpNames
+		} else if c.helpNames, err = c.loadNameTable("Help 009"); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return c.counterNames, c.helpNames, nil
+}
+
+func (c *Client) loadNameTable(tableName string) (*NameTable, error) {
+	buffer, err := c.queryRaw(c.buffers, tableName)
+
+	if err != nil {
+		return nil, fmt.Errorf("perflib: failed to load name table %q: %v", tableName, err)
+	}
+
+	return ParseNameTable(buffer)
+}
@@ -0,0 +1,145 @@
+package perflib
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/leoluk/perflib_exporter/perflib/perflibtest"
+)
+
+// Returns a client which serves synthetic data instead of querying the
+// registry. Each query returns a single Process object with one instance per
+// object index in the query. Run with -race to check for data races.
+func newFakeClient(opts *Options) (*Client, func() int) {
+	var (
+		mu      sync.Mutex
+		queries int
+	)
+
+	raw := map[string][]byte{
+		"Counter 009": perflibtest.NameTable(map[uint32]string{230: "Process", 784: "ID Process"}),
+		"Help 009":    perflibtest.NameTable(map[uint32]string{231: "Process help", 785: "ID Process help"}),
+	}
+
+	c := NewClient(opts)
+	c.queryRaw = func(buffers *bufferPool, query string) ([]byte, error) {
+		mu.Lock()
+		queries++
+		mu.Unlock()
+
+		data, ok := raw[query]
+
+		if !ok {
+			b := perflibtest.New()
+			process := b.AddObject(230)
+			process.AddCounter(784, 0x00010000, 4)
+			process.AddInstance(query, int64(len(query)))
+			data = b.Bytes()
+		}
+
+		// Go through the pool like the registry does, so its buffers are exercised
+		buffer := buffers.get(query)
+
+		if len(buffer) < len(data) {
+			return nil, errors.New("buffer too small")
+		}
+
+		n := copy(buffer, data)
+		buffers.done(query, n)
+
+		return buffer[:n], nil
+	}
+
+	return c, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return queries
+	}
+}
+
+func TestClientConcurrentQueries(t *testing.T) {
+	c, queries := newFakeClient(nil)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			// Few distinct queries, so buffers are shared and reused between goroutines
+			query := fmt.Sprintf("%d", 230+i%3)
+			snapshot, err := c.Query(query)
+
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			inst := snapshot.Objects[0].Instances[0]
+
+			if inst.Name != query || inst.Counters[0].Value != int64(len(query)) ||
+				inst.Counters[0].Def.Name != "ID Process" || inst.Counters[0].Def.HelpText != "ID Process help" {
+				errs <- fmt.Errorf("unexpected result for %q: %q = %d", query, inst.Name, inst.Counters[0].Value)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// Name tables are loaded once, no matter how many queries ran concurrently
+	if n := queries(); n != 102 {
+		t.Errorf("expected 100 queries and 2 name table loads, got %d", n)
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	names := NewNameTable(map[uint32]string{230: "Prozess"})
+	c, queries := newFakeClient(&Options{CounterNames: names, SkipHelpTexts: true})
+
+	snapshot, err := c.Query("230")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	process := snapshot.Objects[0]
+	if process.Name != "Prozess" || process.HelpText != "" {
+		t.Errorf("unexpected names %q %q", process.Name, process.HelpText)
+	}
+
+	if n := queries(); n != 1 {
+		t.Errorf("expected no name tables to be loaded, got %d queries", n)
+	}
+}
+
+func TestClientError(t *testing.T) {
+	c, _ := newFakeClient(nil)
+	fakeQuery := c.queryRaw
+
+	c.queryRaw = func(buffers *bufferPool, query string) ([]byte, error) {
+		return nil, errors.New("registry unavailable")
+	}
+
+	if _, err := c.Query("Global"); err == nil {
+		t.Error("expected an error")
+	}
+	if _, _, err := c.NameTables(); err == nil {
+		t.Error("expected a name table error")
+	}
+
+	// Failed name table loads aren't cached
+	c.queryRaw = fakeQuery
+
+	if counterNames, _, err := c.NameTables(); err != nil || counterNames.LookupString(230) != "Process" {
+		t.Errorf("expected the name tables to load after a failure, got %v", err)
+	}
+}
@@ -0,0 +1,25 @@
+package perflib
+
+import "fmt"
+
+// ParseError is returned when a perflib buffer is truncated or otherwise
+// malformed. Offset is the absolute position of the offending structure
+// within the buffer.
+type ParseError struct {
+	Offset int64
+	// Name of the structure as defined in winperf.h ("PERF_OBJECT_TYPE")
+	Struct string
+	Msg    string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("perflib: invalid %s at offset %d: %s", e.Struct, e.Offset, e.Msg)
+}
+
+func parseErrorf(offset int64, structName string, format string, args ...interface{}) *ParseError {
+	return &ParseError{
+		Offset: offset,
+		Struct: structName,
+		Msg:    fmt.Sprintf(format, args...),
+	}
+}
@@ -0,0 +1,228 @@
+/*
+Calculation of formatted ("cooked") counter values, as shown by the Windows
+Performance Monitor.
+
+The perflib package only returns raw values. Most counter types need two
+successive samples to calculate a value - for example, PERF_COUNTER_COUNTER
+is a rate and PERF_100NSEC_TIMER is the percentage of time spent in a state
+during the sample interval.
+
+The formulas are documented in winperf.h and at
+https://docs.microsoft.com/en-us/windows/win32/perfctrs/counter-types
+*/
+package formatted
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Counter types from winperf.h (same values as in collector/mapper.go)
+const (
+	perfCounterRawcountHex         = 0x00000000
+	perfCounterLargeRawcountHex    = 0x00000100
+	perfCounterRawcount            = 0x00010000
+	perfCounterLargeRawcount       = 0x00010100
+	perfDoubleRaw                  = 0x00012000
+	perfCounterDelta               = 0x00400400
+	perfCounterLargeDelta          = 0x00400500
+	perfSampleCounter              = 0x00410400
+	perfCounterQueuelenType        = 0x00450400
+	perfCounterLargeQueuelenType   = 0x00450500
+	perfCounter100nsQueuelenType   = 0x00550500
+	perfCounterObjTimeQueuelenType = 0x00650500
+	perfCounterCounter             = 0x10410400
+	perfCounterBulkCount           = 0x10410500
+	perfRawFraction                = 0x20020400
+	perfLargeRawFraction           = 0x20020500
+	perfCounterTimer               = 0x20410500
+	perfPrecisionSystemTimer       = 0x20470500
+	perf100nsecTimer               = 0x20510500
+	perfPrecision100nsTimer        = 0x20570500
+	perfObjTimeTimer               = 0x20610500
+	perfPrecisionObjectTimer       = 0x20670500
+	perfSampleFraction             = 0x20c20400
+	perfCounterTimerInv            = 0x21410500
+	perf100nsecTimerInv            = 0x21510500
+	perfCounterMultiTimer          = 0x22410500
+	perf100nsecMultiTimer          = 0x22510500
+	perfCounterMultiTimerInv       = 0x23410500
+	perf100nsecMultiTimerInv       = 0x23510500
+	perfAverageTimer               = 0x30020400
+	perfElapsedTime                = 0x30240500
+	perfAverageBulk                = 0x40020500
+)
+
+var (
+	// The counter type has no formatted value (text, histogram or base counters).
+	ErrUnsupported = errors.New("formatted: unsupported counter type")
+
+	// The samples cannot be used to calculate a value, for example because
+	// no time passed between them or a counter was reset.
+	ErrInvalidData = errors.New("formatted: invalid sample data")
+)
+
+// A raw counter value along with the time bases it was collected at.
+type Sample struct {
+	Value int64
+	// Raw value of the counter's base counter (PERF_*_BASE), if it has one
+	Base int64
+
+	// PerfTime and PerfFreq of the data block
+	Time int64
+	Freq int64
+	// PerfTime100nSec of the data block
+	Time100nSec int64
+
+	// PerfTime and PerfFreq of the counter's object
+	ObjectTime int64
+	ObjectFreq int64
+}
+
+// Whether the counter type is calculated using a base counter.
+func NeedsBase(counterType uint32) bool {
+	switch counterType {
+	case perfRawFraction, perfLargeRawFraction, perfSampleFraction,
+		perfPrecisionSystemTimer, perfPrecision100nsTimer, perfPrecisionObjectTimer,
+		perfCounterMultiTimer, perf100nsecMultiTimer, perfCounterMultiTimerInv, perf100nsecMultiTimerInv,
+		perfAverageTimer, perfAverageBulk:
+		return true
+	}
+
+	return false
+}
+
+// Whether the counter type is calculated from a single sample.
+func IsInstantaneous(counterType uint32) bool {
+	switch counterType {
+	case perfCounterRawcountHex, perfCounterLargeRawcountHex, perfCounterRawcount, perfCounterLargeRawcount,
+		perfDoubleRaw, perfRawFraction, perfLargeRawFraction, perfElapsedTime:
+		return true
+	}
+
+	return false
+}
+
+/*
+Calculate the formatted value of a counter from two successive samples.
+
+For instantaneous counter types (see IsInstantaneous), prev is ignored.
+Percentages are returned in the range 0-100, like Performance Monitor does.
+*/
+func Compute(counterType uint32, prev, cur Sample) (float64, error) {
+	n := float64(cur.Value - prev.Value)
+	b := float64(cur.Base - prev.Base)
+
+	switch counterType {
+	case perfCounterRawcountHex, perfCounterLargeRawcountHex, perfCounterRawcount, perfCounterLargeRawcount:
+		return float64(cur.Value), nil
+
+	case perfDoubleRaw:
+		return math.Float64frombits(uint64(cur.Value)), nil
+
+	case perfCounterDelta, perfCounterLargeDelta:
+		return n, nil
+
+	case perfRawFraction, perfLargeRawFraction:
+		return ratio(100*float64(cur.Value), float64(cur.Base))
+
+	case perfElapsedTime:
+		return ratio(float64(cur.ObjectTime-cur.Value), float64(cur.ObjectFreq))
+
+	case perfCounterCounter, perfCounterBulkCount, perfSampleCounter:
+		// Events per second
+		return ratio(n, seconds(prev.Time, cur.Time, cur.Freq))
+
+	case perfCounterQueuelenType, perfCounterLargeQueuelenType:
+		return ratio(n, float64(cur.Time-prev.Time))
+
+	case perfCounter100nsQueuelenType:
+		return ratio(n, float64(cur.Time100nSec-prev.Time100nSec))
+
+	case perfCounterObjTimeQueuelenType:
+		return ratio(n, float64(cur.ObjectTime-prev.ObjectTime))
+
+	case perfCounterTimer:
+		return ratio(100*n, float64(cur.Time-prev.Time))
+
+	case perf100nsecTimer:
+		return ratio(100*n, float64(cur.Time100nSec-prev.Time100nSec))
+
+	case perfObjTimeTimer:
+		return ratio(100*n, float64(cur.ObjectTime-prev.ObjectTime))
+
+	case perfPrecisionSystemTimer, perfPrecision100nsTimer, perfPrecisionObjectTimer, perfSampleFraction:
+		return ratio(100*n, b)
+
+	case perfCounterTimerInv:
+		return inverse(n, float64(cur.Time-prev.Time), 1)
+
+	case perf100nsecTimerInv:
+		return inverse(n, float64(cur.Time100nSec-prev.Time100nSec), 1)
+
+	case perfCounterMultiTimer:
+		v, err := ratio(100*n, float64(cur.Time-prev.Time))
+		return divideBy(v, err, float64(cur.Base))
+
+	case perf100nsecMultiTimer:
+		v, err := ratio(100*n, float64(cur.Time100nSec-prev.Time100nSec))
+		return divideBy(v, err, float64(cur.Base))
+
+	case perfCounterMultiTimerInv:
+		return inverse(n, float64(cur.Time-prev.Time), float64(cur.Base))
+
+	case perf100nsecMultiTimerInv:
+		return inverse(n, float64(cur.Time100nSec-prev.Time100nSec), float64(cur.Base))
+
+	case perfAverageTimer:
+		// Seconds per operation
+		return ratio(n/float64(cur.Freq), b)
+
+	case perfAverageBulk:
+		return ratio(n, b)
+	}
+
+	return 0, fmt.Errorf("%w %#08x", ErrUnsupported, counterType)
+}
+
+func seconds(t0, t1, freq int64) float64 {
+	if freq == 0 {
+		return 0
+	}
+
+	return float64(t1-t0) / float64(freq)
+}
+
+func ratio(n, d float64) (float64, error) {
+	if d <= 0 || n < 0 || math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0, ErrInvalidData
+	}
+
+	return n / d, nil
+}
+
+func divideBy(v float64, err error, d float64) (float64, error) {
+	if err != nil {
+		return 0, err
+	}
+
+	return ratio(v, d)
+}
+
+// 100 * (items - n/d), as used by the *_INV timers. items is 1 unless it's a multi timer.
+func inverse(n, d, items float64) (float64, error) {
+	v, err := ratio(n, d)
+
+	if err != nil {
+		return 0, err
+	}
+
+	v = 100 * (items - v)
+
+	if v < 0 {
+		return 0, ErrInvalidData
+	}
+
+	return v, nil
+}
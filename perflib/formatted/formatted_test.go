@@ -0,0 +1,172 @@
+package formatted
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/leoluk/perflib_exporter/perflib"
+	"github.com/leoluk/perflib_exporter/perflib/perflibtest"
+)
+
+func TestCompute(t *testing.T) {
+	// One second apart, with a 10 MHz performance counter
+	t0 := Sample{Time: 50000000, Freq: 10000000, Time100nSec: 131616922800000000, ObjectTime: 1000, ObjectFreq: 1000}
+	t1 := Sample{Time: 60000000, Freq: 10000000, Time100nSec: 131616922810000000, ObjectTime: 2000, ObjectFreq: 1000}
+
+	with := func(s Sample, value, base int64) Sample {
+		s.Value = value
+		s.Base = base
+		return s
+	}
+
+	for _, tc := range []struct {
+		name        string
+		counterType uint32
+		prev, cur   Sample
+		expected    float64
+	}{
+		{"PERF_COUNTER_RAWCOUNT", perfCounterRawcount, with(t0, 5, 0), with(t1, 7, 0), 7},
+		{"PERF_COUNTER_LARGE_RAWCOUNT_HEX", perfCounterLargeRawcountHex, with(t0, 5, 0), with(t1, 1<<40, 0), 1 << 40},
+		{"PERF_DOUBLE_RAW", perfDoubleRaw, t0, with(t1, int64(math.Float64bits(2.5)), 0), 2.5},
+		{"PERF_COUNTER_DELTA", perfCounterDelta, with(t0, 5, 0), with(t1, 7, 0), 2},
+		{"PERF_COUNTER_COUNTER", perfCounterCounter, with(t0, 100, 0), with(t1, 350, 0), 250},
+		{"PERF_COUNTER_BULK_COUNT", perfCounterBulkCount, with(t0, 1000, 0), with(t1, 5096, 0), 4096},
+		{"PERF_SAMPLE_COUNTER", perfSampleCounter, with(t0, 0, 0), with(t1, 10, 0), 10},
+		{"PERF_COUNTER_QUEUELEN_TYPE", perfCounterQueuelenType, with(t0, 0, 0), with(t1, 30000000, 0), 3},
+		{"PERF_COUNTER_100NS_QUEUELEN_TYPE", perfCounter100nsQueuelenType, with(t0, 0, 0), with(t1, 5000000, 0), 0.5},
+		{"PERF_COUNTER_OBJ_TIME_QUEUELEN_TYPE", perfCounterObjTimeQueuelenType, with(t0, 0, 0), with(t1, 2000, 0), 2},
+		{"PERF_RAW_FRACTION", perfRawFraction, t0, with(t1, 25, 200), 12.5},
+		{"PERF_LARGE_RAW_FRACTION", perfLargeRawFraction, t0, with(t1, 1, 4), 25},
+		{"PERF_SAMPLE_FRACTION", perfSampleFraction, with(t0, 10, 100), with(t1, 15, 120), 25},
+		{"PERF_COUNTER_TIMER", perfCounterTimer, with(t0, 0, 0), with(t1, 2500000, 0), 25},
+		{"PERF_100NSEC_TIMER", perf100nsecTimer, with(t0, 0, 0), with(t1, 7500000, 0), 75},
+		{"PERF_OBJ_TIME_TIMER", perfObjTimeTimer, with(t0, 0, 0), with(t1, 100, 0), 10},
+		{"PERF_PRECISION_SYSTEM_TIMER", perfPrecisionSystemTimer, with(t0, 0, 1000), with(t1, 50, 1200), 25},
+		{"PERF_PRECISION_100NS_TIMER", perfPrecision100nsTimer, with(t0, 0, 1000), with(t1, 100, 1200), 50},
+		{"PERF_PRECISION_OBJECT_TIMER", perfPrecisionObjectTimer, with(t0, 0, 1000), with(t1, 200, 1200), 100},
+		{"PERF_COUNTER_TIMER_INV", perfCounterTimerInv, with(t0, 0, 0), with(t1, 2500000, 0), 75},
+		{"PERF_100NSEC_TIMER_INV", perf100nsecTimerInv, with(t0, 0, 0), with(t1, 9000000, 0), 10},
+		{"PERF_COUNTER_MULTI_TIMER", perfCounterMultiTimer, with(t0, 0, 0), with(t1, 10000000, 4), 25},
+		{"PERF_100NSEC_MULTI_TIMER", perf100nsecMultiTimer, with(t0, 0, 0), with(t1, 20000000, 4), 50},
+		{"PERF_COUNTER_MULTI_TIMER_INV", perfCounterMultiTimerInv, with(t0, 0, 0), with(t1, 10000000, 4), 300},
+		{"PERF_100NSEC_MULTI_TIMER_INV", perf100nsecMultiTimerInv, with(t0, 0, 0), with(t1, 30000000, 4), 100},
+		{"PERF_AVERAGE_TIMER", perfAverageTimer, with(t0, 0, 10), with(t1, 500000, 20), 0.005},
+		{"PERF_AVERAGE_BULK", perfAverageBulk, with(t0, 4096, 1), with(t1, 69632, 9), 8192},
+		{"PERF_ELAPSED_TIME", perfElapsedTime, t0, with(t1, 500, 0), 1.5},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			value, err := Compute(tc.counterType, tc.prev, tc.cur)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(value-tc.expected) > 1e-9 {
+				t.Errorf("expected %v, got %v", tc.expected, value)
+			}
+		})
+	}
+}
+
+func TestComputeErrors(t *testing.T) {
+	t0 := Sample{Value: 100, Time: 50000000, Freq: 10000000}
+
+	if _, err := Compute(perfCounterCounter, t0, t0); !errors.Is(err, ErrInvalidData) {
+		t.Errorf("expected ErrInvalidData without elapsed time, got %v", err)
+	}
+
+	reset := t0
+	reset.Value = 0
+	reset.Time += 10000000
+
+	if _, err := Compute(perfCounterCounter, t0, reset); !errors.Is(err, ErrInvalidData) {
+		t.Errorf("expected ErrInvalidData after a counter reset, got %v", err)
+	}
+
+	if _, err := Compute(0x40030402, t0, t0); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("expected ErrUnsupported for PERF_AVERAGE_BASE, got %v", err)
+	}
+}
+
+func testSnapshot(perfTime int64, values ...int64) *perflib.Snapshot {
+	defs := []*perflib.PerfCounterDef{
+		{Name: "Bytes/sec", NameIndex: 10, CounterType: perfCounterBulkCount},
+		{Name: "Avg. Disk sec/Read", NameIndex: 12, CounterType: perfAverageTimer},
+		{Name: "Avg. Disk sec/Read Base", NameIndex: 14, CounterType: 0x40030402, IsBaseValue: true},
+	}
+	defs[1].Base = defs[2]
+
+	object := &perflib.PerfObject{Name: "LogicalDisk", NameIndex: 236, CounterDefs: defs, Frequency: 10000000}
+
+	for i := 0; i < len(values); i += len(defs) {
+		instance := &perflib.PerfInstance{Name: "C:"}
+
+		for j, def := range defs {
+			instance.Counters = append(instance.Counters, &perflib.PerfCounter{Value: values[i+j], Def: def})
+		}
+		instance.Counters[1].BaseValue = instance.Counters[2].Value
+
+		object.Instances = append(object.Instances, instance)
+	}
+
+	return &perflib.Snapshot{
+		PerfDataHeader: perflib.PerfDataHeader{PerfTime: perfTime, PerfFreq: 10000000},
+		Objects:        []*perflib.PerfObject{object},
+	}
+}
+
+func TestFormatter(t *testing.T) {
+	f := new(Formatter)
+
+	if objects := f.Update(testSnapshot(0, 0, 0, 0)); objects != nil {
+		t.Fatal("expected no values for the first snapshot")
+	}
+
+	// Two seconds later, with 4 reads taking 20ms in total
+	objects := f.Update(testSnapshot(20000000, 2048, 200000, 4))
+
+	counters := objects[0].Instances[0].Counters
+	if len(counters) != 2 {
+		t.Fatalf("expected 2 counters (without the base), got %d", len(counters))
+	}
+	if counters[0].Def.NameIndex != 10 || counters[0].Value != 1024 {
+		t.Errorf("unexpected %s = %v", counters[0].Def.Name, counters[0].Value)
+	}
+	if counters[1].Def.NameIndex != 12 || math.Abs(counters[1].Value-0.005) > 1e-9 {
+		t.Errorf("unexpected %s = %v", counters[1].Def.Name, counters[1].Value)
+	}
+}
+
+// Precision timers are divided by their timestamp, which follows them as a base
+func TestComputeSnapshotPrecisionTimer(t *testing.T) {
+	parse := func(timer, timestamp int64) *perflib.Snapshot {
+		b := perflibtest.New()
+
+		adapter := b.AddObject(5000)
+		adapter.AddCounter(5002, perfCounterRawcount, 4)
+		adapter.AddCounter(5004, perfPrecision100nsTimer, 8)
+		adapter.AddCounter(5006, 0x40030500, 8) // PERF_PRECISION_TIMESTAMP
+		adapter.SetValues(3, timer, timestamp)
+
+		snapshot, err := perflib.ParseSnapshot(b.Bytes(), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return snapshot
+	}
+
+	// Busy for half of the second between the timestamps
+	objects := ComputeSnapshot(parse(0, 10000000), parse(5000000, 20000000))
+
+	counters := objects[0].Instances[0].Counters
+	if len(counters) != 2 {
+		t.Fatalf("expected 2 counters (without the timestamp), got %d", len(counters))
+	}
+	if counters[0].Def.NameIndex != 5002 || counters[0].Value != 3 {
+		t.Errorf("unexpected [%d] = %v", counters[0].Def.NameIndex, counters[0].Value)
+	}
+	if counters[1].Def.NameIndex != 5004 || math.Abs(counters[1].Value-50) > 1e-9 {
+		t.Errorf("unexpected [%d] = %v", counters[1].Def.NameIndex, counters[1].Value)
+	}
+}
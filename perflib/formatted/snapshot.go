@@ -0,0 +1,175 @@
+package formatted
+
+import (
+	"sync"
+
+	"github.com/leoluk/perflib_exporter/perflib"
+)
+
+// Formatted value of a single counter.
+type Counter struct {
+	Def   *perflib.PerfCounterDef
+	Value float64
+}
+
+type Instance struct {
+	Name     string
+	Counters []*Counter
+}
+
+type Object struct {
+	Name      string
+	NameIndex uint
+	Instances []*Instance
+}
+
+/*
+Calculate formatted values for all counters in cur, using prev as the earlier sample.
+
+Objects are matched by their index and instances by their name. Counters that
+cannot be formatted (base counters, unsupported types, or counters missing from
+prev) are left out. Both snapshots need to come from the same machine.
+*/
+func ComputeSnapshot(prev, cur *perflib.Snapshot) []*Object {
+	objects := make([]*Object, 0, len(cur.Objects))
+
+	for _, curObject := range cur.Objects {
+		prevObject := prev.Object(curObject.NameIndex)
+
+		object := &Object{
+			Name:      curObject.Name,
+			NameIndex: curObject.NameIndex,
+			Instances: make([]*Instance, 0, len(curObject.Instances)),
+		}
+
+		var prevInstances map[instanceKey]*perflib.PerfInstance
+
+		if prevObject != nil {
+			prevInstances = indexInstances(prevObject.Instances)
+		}
+
+		seen := make(map[string]int)
+
+		for _, curInstance := range curObject.Instances {
+			// Instance names aren't unique (think svchost), so we match by occurrence as well
+			key := instanceKey{curInstance.Name, seen[curInstance.Name]}
+			seen[curInstance.Name]++
+
+			prevInstance := prevInstances[key]
+
+			instance := &Instance{
+				Name:     curInstance.Name,
+				Counters: make([]*Counter, 0, len(curInstance.Counters)),
+			}
+
+			for i, counter := range curInstance.Counters {
+				if counter.Def.IsBaseValue {
+					continue
+				}
+
+				curSample, ok := sample(&cur.PerfDataHeader, curObject, curInstance, i)
+
+				if !ok {
+					continue
+				}
+
+				prevSample := curSample
+
+				if !IsInstantaneous(counter.Def.CounterType) {
+					if prevInstance == nil || i >= len(prevInstance.Counters) ||
+						prevInstance.Counters[i].Def.NameIndex != counter.Def.NameIndex {
+						continue
+					}
+
+					prevSample, ok = sample(&prev.PerfDataHeader, prevObject, prevInstance, i)
+
+					if !ok {
+						continue
+					}
+				}
+
+				value, err := Compute(counter.Def.CounterType, prevSample, curSample)
+
+				if err != nil {
+					continue
+				}
+
+				instance.Counters = append(instance.Counters, &Counter{
+					Def:   counter.Def,
+					Value: value,
+				})
+			}
+
+			object.Instances = append(object.Instances, instance)
+		}
+
+		objects = append(objects, object)
+	}
+
+	return objects
+}
+
+type instanceKey struct {
+	name       string
+	occurrence int
+}
+
+func indexInstances(instances []*perflib.PerfInstance) map[instanceKey]*perflib.PerfInstance {
+	index := make(map[instanceKey]*perflib.PerfInstance, len(instances))
+	seen := make(map[string]int)
+
+	for _, instance := range instances {
+		index[instanceKey{instance.Name, seen[instance.Name]}] = instance
+		seen[instance.Name]++
+	}
+
+	return index
+}
+
+// Build a sample for the i-th counter of an instance. Returns false if the counter
+// needs a base, but doesn't have one.
+func sample(header *perflib.PerfDataHeader, object *perflib.PerfObject, instance *perflib.PerfInstance, i int) (Sample, bool) {
+	counter := instance.Counters[i]
+
+	s := Sample{
+		Value:       counter.Value,
+		Base:        counter.BaseValue,
+		Time:        header.PerfTime,
+		Freq:        header.PerfFreq,
+		Time100nSec: header.PerfTime100nSec,
+		ObjectTime:  object.PerfTime,
+		ObjectFreq:  object.Frequency,
+	}
+
+	if NeedsBase(counter.Def.CounterType) && counter.Def.Base == nil {
+		return s, false
+	}
+
+	return s, true
+}
+
+// A Formatter calculates formatted values from a series of snapshots,
+// remembering the previous one. It is safe for concurrent use.
+type Formatter struct {
+	mu   sync.Mutex
+	prev *perflib.Snapshot
+}
+
+/*
+Calculate formatted values relative to the snapshot passed in the previous call.
+
+The first call only records the snapshot and returns nil.
+*/
+func (f *Formatter) Update(s *perflib.Snapshot) []*Object {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	prev := f.prev
+	f.prev = s
+
+	if prev == nil {
+		return nil
+	}
+
+	return ComputeSnapshot(prev, s)
+}
@@ -1,75 +1,374 @@
 package perflib
 
 import (
-	"bytes"
-	"strconv"
+	"encoding/json"
 	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf16"
 )
 
-type nameTableLookuper interface {
-	LookupName() string
-	LookupHelp() string
+// A NameTable maps the indices used in performance data to names or help texts.
+// Indices are unique, names are not: several counters share a name, like
+// "Bytes Total/sec" on different network objects.
+type NameTable struct {
+	byIndex map[uint32]string
+	// Sorted in ascending order
+	byString map[string][]uint32
 }
 
-func (p *perfObjectType) LookupName() string {
-	return CounterNameTable.LookupString(p.ObjectNameTitleIndex)
+// A single entry of a NameTable.
+type NameTableEntry struct {
+	Index uint32 `json:"index"`
+	Name  string `json:"name"`
 }
 
-func (p *perfObjectType) LookupHelp() string {
-	return HelpNameTable.LookupString(p.ObjectHelpTitleIndex)
-}
+// Create a name table from a map of indices to names.
+func NewNameTable(entries map[uint32]string) *NameTable {
+	t := &NameTable{
+		byIndex:  make(map[uint32]string, len(entries)),
+		byString: make(map[string][]uint32, len(entries)),
+	}
 
-type NameTable struct {
-	byIndex  map[uint32]string
-	byString map[string]uint32
+	for index, name := range entries {
+		t.byIndex[index] = name
+		t.byString[name] = append(t.byString[name], index)
+	}
+
+	for _, indices := range t.byString {
+		sortIndices(indices)
+	}
+
+	return t
 }
 
 func (t *NameTable) LookupString(index uint32) string {
+	if t == nil {
+		return ""
+	}
+
 	return t.byIndex[index]
 }
 
+// Return the lowest index with the given name, or 0 if there is none.
+// Use LookupIndices for names which are used more than once.
 func (t *NameTable) LookupIndex(str string) uint32 {
-	return t.byString[str]
+	if indices := t.LookupIndices(str); len(indices) > 0 {
+		return indices[0]
+	}
+
+	return 0
+}
+
+// Return all indices with the given name, in ascending order.
+func (t *NameTable) LookupIndices(str string) []uint32 {
+	if t == nil {
+		return nil
+	}
+
+	return append([]uint32(nil), t.byString[str]...)
+}
+
+// Like LookupIndices, but compares names case-insensitively.
+func (t *NameTable) LookupIndicesFold(str string) []uint32 {
+	var indices []uint32
+
+	for _, e := range t.Search(func(name string) bool { return strings.EqualFold(name, str) }) {
+		indices = append(indices, e.Index)
+	}
+
+	return indices
+}
+
+// Return all entries whose name starts with prefix, optionally ignoring case.
+func (t *NameTable) SearchPrefix(prefix string, ignoreCase bool) []NameTableEntry {
+	if ignoreCase {
+		prefix = strings.ToLower(prefix)
+	}
+
+	return t.Search(func(name string) bool {
+		if ignoreCase {
+			name = strings.ToLower(name)
+		}
+
+		return strings.HasPrefix(name, prefix)
+	})
+}
+
+// Return all entries whose name matches re. Use the (?i) flag for a
+// case-insensitive search.
+func (t *NameTable) SearchRegexp(re *regexp.Regexp) []NameTableEntry {
+	return t.Search(re.MatchString)
+}
+
+// Return all entries whose name satisfies match, ordered by index.
+func (t *NameTable) Search(match func(name string) bool) []NameTableEntry {
+	var entries []NameTableEntry
+
+	for _, e := range t.Entries() {
+		if match(e.Name) {
+			entries = append(entries, e)
+		}
+	}
+
+	return entries
+}
+
+// Number of entries in the table.
+func (t *NameTable) Len() int {
+	if t == nil {
+		return 0
+	}
+
+	return len(t.byIndex)
+}
+
+// All entries of the table, ordered by index.
+func (t *NameTable) Entries() []NameTableEntry {
+	if t == nil {
+		return nil
+	}
+
+	entries := make([]NameTableEntry, 0, len(t.byIndex))
+
+	for index, name := range t.byIndex {
+		entries = append(entries, NameTableEntry{index, name})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Index < entries[j].Index
+	})
+
+	return entries
+}
+
+// Serialize the table as a JSON array of entries, ordered by index.
+func (t *NameTable) MarshalJSON() ([]byte, error) {
+	entries := t.Entries()
+
+	if entries == nil {
+		entries = []NameTableEntry{}
+	}
+
+	return json.Marshal(entries)
+}
+
+// Load a table serialized by MarshalJSON, replacing all entries.
+func (t *NameTable) UnmarshalJSON(data []byte) error {
+	var entries []NameTableEntry
+
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	m := make(map[uint32]string, len(entries))
+
+	for _, e := range entries {
+		m[e.Index] = e.Name
+	}
+
+	*t = *NewNameTable(m)
+
+	return nil
+}
+
+func sortIndices(indices []uint32) {
+	sort.Slice(indices, func(i, j int) bool {
+		return indices[i] < indices[j]
+	})
 }
 
 // Query a perflib name table from the registry. Specify the type and the language
 // code (i.e. "Counter 009" or "Help 009") for English language.
+//
+// Deprecated: panics on failure. Use LoadNameTable instead.
 func QueryNameTable(tableName string) *NameTable {
-	nameTable := new(NameTable)
-	nameTable.byIndex = make(map[uint32]string)
+	table, err := LoadNameTable(tableName)
+	if err != nil {
+		panic(err)
+	}
 
+	return table
+}
+
+// Like QueryNameTable, but returns an error instead of panicking.
+func LoadNameTable(tableName string) (*NameTable, error) {
 	buffer, err := queryRawData(tableName)
+
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("perflib: failed to load name table %q: %v", tableName, err)
 	}
-	r := bytes.NewReader(buffer)
-	for {
-		index, err := readUTF16String(r)
+
+	return ParseNameTable(buffer)
+}
+
+/*
+Load the counter name and help tables for a language, given as the three-digit
+hexadecimal primary language ID used by the registry ("009" for English, "007"
+for German, "011" for Japanese) or "CurrentLanguage" for the system's UI language.
+
+Only the languages installed on the system are available. Object and counter
+indices are the same across languages.
+*/
+func QueryLanguageNameTables(language string) (counterNames, helpNames *NameTable, err error) {
+	if language == "009" {
+		counterNames, err = defaultNameTable("Counter 009")
 
 		if err != nil {
-			break
+			return nil, nil, err
+		}
+
+		helpNames, err = defaultNameTable("Help 009")
+
+		if err != nil {
+			return nil, nil, err
 		}
 
-		desc, err := readUTF16String(r)
+		return counterNames, helpNames, nil
+	}
+
+	tables := make([]*NameTable, 2)
+
+	for i, kind := range []string{"Counter", "Help"} {
+		tableName := kind + " " + language
+		tables[i], err = LoadNameTable(tableName)
 
 		if err != nil {
+			return nil, nil, err
+		}
+
+		// Unknown languages yield an empty value rather than an error
+		if len(tables[i].byIndex) == 0 {
+			return nil, nil, fmt.Errorf("perflib: no name table %q (language not installed?)", tableName)
+		}
+	}
+
+	return tables[0], tables[1], nil
+}
+
+// The English name tables used by QueryPerformanceData, nil until loaded
+var (
+	defaultNameTablesMu sync.Mutex
+	defaultCounterNames *NameTable
+	defaultHelpNames    *NameTable
+)
+
+// The English counter name table used by QueryPerformanceData, loaded from the
+// registry on first use. Safe for concurrent use.
+func DefaultCounterNames() (*NameTable, error) {
+	return defaultNameTable("Counter 009")
+}
+
+// Like DefaultCounterNames, but for help texts.
+func DefaultHelpNames() (*NameTable, error) {
+	return defaultNameTable("Help 009")
+}
+
+/*
+Return one of the English name tables used by QueryPerformanceData, loading it
+from the registry the first time. Failures aren't cached, so the next query
+tries again.
+
+Loaded tables are never modified, so they can be shared without locking.
+*/
+func defaultNameTable(tableName string) (*NameTable, error) {
+	defaultNameTablesMu.Lock()
+	defer defaultNameTablesMu.Unlock()
+
+	var table **NameTable
+	var legacy *NameTable
+
+	switch tableName {
+	case "Counter 009":
+		table, legacy = &defaultCounterNames, &CounterNameTable
+	case "Help 009":
+		table, legacy = &defaultHelpNames, &HelpNameTable
+	default:
+		return nil, fmt.Errorf("perflib: %q is not a default name table", tableName)
+	}
+
+	if *table != nil {
+		return *table, nil
+	}
+
+	loaded, err := LoadNameTable(tableName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	*table = loaded
+
+	// Kept for compatibility, see CounterNameTable
+	*legacy = *loaded
+
+	return loaded, nil
+}
+
+/*
+Parse a raw name table, as returned by RegQueryValueEx for "Counter 009" or
+"Help 009": alternating, null-terminated UTF-16 (little endian) index and name
+strings, optionally followed by an empty string.
+
+Returns a *ParseError if the table is truncated or contains an invalid index.
+*/
+func ParseNameTable(buffer []byte) (*NameTable, error) {
+	if len(buffer)%2 != 0 {
+		return nil, parseErrorf(int64(len(buffer)-1), "name table", "odd length %d", len(buffer))
+	}
+
+	// Decode everything at once, then split at the null terminators
+	chars := make([]uint16, len(buffer)/2)
+
+	for i := range chars {
+		chars[i] = bo.Uint16(buffer[i*2:])
+	}
+
+	byIndex := make(map[uint32]string)
+
+	pos := 0
+	for pos < len(chars) {
+		index, indexEnd := nextUTF16String(chars, pos)
+
+		// End of table
+		if len(index) == 0 {
 			break
 		}
 
-		indexInt, _ := strconv.Atoi(index)
+		if indexEnd < 0 {
+			return nil, parseErrorf(int64(pos*2), "name table", "unterminated index")
+		}
+
+		indexInt, err := strconv.ParseUint(string(utf16.Decode(index)), 10, 32)
 
 		if err != nil {
-			panic(fmt.Sprint("Invalid index ", index))
+			return nil, parseErrorf(int64(pos*2), "name table", "invalid index %q", string(utf16.Decode(index)))
 		}
 
-		nameTable.byIndex[uint32(indexInt)] = desc
+		name, nameEnd := nextUTF16String(chars, indexEnd+1)
+
+		if nameEnd < 0 {
+			return nil, parseErrorf(int64((indexEnd+1)*2), "name table", "missing or unterminated name for index %d", indexInt)
+		}
+
+		byIndex[uint32(indexInt)] = string(utf16.Decode(name))
+		pos = nameEnd + 1
 	}
 
-	nameTable.byString = make(map[string]uint32)
+	return NewNameTable(byIndex), nil
+}
 
-	for k, v := range nameTable.byIndex {
-		nameTable.byString[v] = k
+// Return the string starting at pos and the position of its null terminator,
+// or -1 if there is none.
+func nextUTF16String(chars []uint16, pos int) ([]uint16, int) {
+	for i := pos; i < len(chars); i++ {
+		if chars[i] == 0 {
+			return chars[pos:i], i
+		}
 	}
 
-	return nameTable
+	return chars[pos:], -1
 }
@@ -0,0 +1,145 @@
+package perflib
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/leoluk/perflib_exporter/perflib/perflibtest"
+)
+
+func testTable() *NameTable {
+	return NewNameTable(map[uint32]string{
+		230:  "Process",
+		232:  "Processor",
+		388:  "Bytes Total/sec",
+		506:  "Bytes Total/sec",
+		1820: "Bytes Total/sec",
+		510:  "Network Interface",
+	})
+}
+
+func TestNameTableLookupIndices(t *testing.T) {
+	table := testTable()
+
+	if indices := table.LookupIndices("Bytes Total/sec"); !reflect.DeepEqual(indices, []uint32{388, 506, 1820}) {
+		t.Errorf("unexpected indices %v", indices)
+	}
+	if index := table.LookupIndex("Bytes Total/sec"); index != 388 {
+		t.Errorf("expected the lowest index, got %d", index)
+	}
+	if indices := table.LookupIndices("Missing"); indices != nil {
+		t.Errorf("expected no indices, got %v", indices)
+	}
+	if indices := table.LookupIndicesFold("bytes total/SEC"); !reflect.DeepEqual(indices, []uint32{388, 506, 1820}) {
+		t.Errorf("unexpected case-insensitive indices %v", indices)
+	}
+
+	var nilTable *NameTable
+	if nilTable.LookupIndex("Process") != 0 || nilTable.Len() != 0 || nilTable.Entries() != nil {
+		t.Error("expected a nil table to be empty")
+	}
+}
+
+func TestNameTableSearch(t *testing.T) {
+	table := testTable()
+
+	expected := []NameTableEntry{{230, "Process"}, {232, "Processor"}}
+
+	if entries := table.SearchPrefix("Proc", false); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("unexpected prefix search result %v", entries)
+	}
+	if entries := table.SearchPrefix("proc", false); entries != nil {
+		t.Errorf("expected a case-sensitive prefix search, got %v", entries)
+	}
+	if entries := table.SearchPrefix("PROC", true); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("unexpected case-insensitive prefix search result %v", entries)
+	}
+	if entries := table.SearchRegexp(regexp.MustCompile(`(?i)^process(or)?$`)); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("unexpected regexp search result %v", entries)
+	}
+}
+
+func TestNameTableJSON(t *testing.T) {
+	table := testTable()
+
+	if table.Len() != 6 || table.Entries()[0] != (NameTableEntry{230, "Process"}) {
+		t.Errorf("unexpected entries %v", table.Entries())
+	}
+
+	data, err := json.Marshal(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := new(NameTable)
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(decoded, table) {
+		t.Errorf("table changed after round trip: %s", data)
+	}
+
+	if data, _ := json.Marshal(new(NameTable)); string(data) != "[]" {
+		t.Errorf("expected an empty array for an empty table, got %s", data)
+	}
+}
+
+func TestParseNameTable(t *testing.T) {
+	entries := map[uint32]string{1: "1847", 2: "System", 4: "Memory", 230: "Process", 1848: ""}
+	raw := perflibtest.NameTable(entries)
+
+	// The registry terminates the table with an additional empty string
+	for _, buffer := range [][]byte{raw, append(append([]byte{}, raw...), 0, 0)} {
+		table, err := ParseNameTable(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(table, NewNameTable(entries)) {
+			t.Errorf("unexpected table %v", table.Entries())
+		}
+	}
+
+	if table, err := ParseNameTable(nil); err != nil || table.Len() != 0 {
+		t.Errorf("expected an empty table, got %v (%v)", table.Entries(), err)
+	}
+}
+
+func TestParseNameTableMalformed(t *testing.T) {
+	raw := perflibtest.NameTable(map[uint32]string{2: "System", 230: "Process"})
+
+	// Truncating anywhere but after a complete name must fail
+	for n := 1; n < len(raw); n++ {
+		if n == len(perflibtest.NameTable(map[uint32]string{2: "System"})) {
+			continue
+		}
+
+		_, err := ParseNameTable(raw[:n])
+		if _, ok := err.(*ParseError); !ok {
+			t.Fatalf("expected a *ParseError for a table truncated to %d bytes, got %v", n, err)
+		}
+	}
+
+	for _, invalid := range []string{"abc", "-1", "4294967296"} {
+		buffer := perflibtest.NameTable(map[uint32]string{2: "System"})
+		buffer = append(buffer, utf16Bytes(invalid)...)
+		buffer = append(buffer, utf16Bytes("Bogus")...)
+
+		_, err := ParseNameTable(buffer)
+		if perr, ok := err.(*ParseError); !ok || perr.Offset != 18 {
+			t.Errorf("expected a *ParseError at offset 18 for index %q, got %v", invalid, err)
+		}
+	}
+}
+
+// Null-terminated UTF-16 (little endian), ASCII only
+func utf16Bytes(s string) []byte {
+	var b []byte
+	for _, c := range s {
+		b = append(b, byte(c), 0)
+	}
+	return append(b, 0, 0)
+}
@@ -0,0 +1,431 @@
+package perflib
+
+import (
+	"encoding/binary"
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/leoluk/perflib_exporter/perflib/perflibtest"
+)
+
+func TestParsePerformanceData(t *testing.T) {
+	b := perflibtest.New()
+	b.PerfTime = 123456789
+
+	system := b.AddObject(2)
+	system.AddCounter(10, 0x00010000, 4)
+	system.AddCounter(12, 0x00010100, 8)
+	system.SetValues(42, 1<<40)
+
+	process := b.AddObject(230)
+	process.AddCounter(784, 0x00010000, 4)
+	process.AddInstance("Idle", 0)
+	process.AddInstance("svchost", 928)
+
+	buffer := b.Bytes()
+
+	names := NewNameTable(map[uint32]string{2: "System", 10: "File Read Operations/sec", 230: "Process"})
+
+	header, objects, err := ParsePerformanceData(buffer, names, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if header.SystemName != "TESTHOST" || header.PerfFreq != 10000000 || header.PerfTime != 123456789 {
+		t.Errorf("unexpected header %+v", header)
+	}
+	if !header.SystemTime.Equal(time.Date(2018, 1, 28, 22, 18, 0, 0, time.UTC)) {
+		t.Errorf("unexpected system time %v", header.SystemTime)
+	}
+
+	if len(objects) != 2 {
+		t.Fatalf("expected 2 objects, got %d", len(objects))
+	}
+
+	if system := objects[0]; system.Name != "System" || system.NameIndex != 2 || system.HelpText != "" {
+		t.Errorf("unexpected object %q [%d] %q", system.Name, system.NameIndex, system.HelpText)
+	}
+	if len(objects[0].Instances) != 1 || objects[0].Instances[0].Name != "" {
+		t.Fatalf("expected a single null instance, got %d", len(objects[0].Instances))
+	}
+
+	counters := objects[0].Instances[0].Counters
+	if counters[0].Value != 42 || counters[0].Def.Name != "File Read Operations/sec" {
+		t.Errorf("unexpected counter %s = %d", counters[0].Def.Name, counters[0].Value)
+	}
+	if counters[1].Value != 1<<40 || counters[1].Def.NameIndex != 12 {
+		t.Errorf("unexpected counter [%d] = %d", counters[1].Def.NameIndex, counters[1].Value)
+	}
+
+	if len(objects[1].Instances) != 2 {
+		t.Fatalf("expected 2 instances, got %d", len(objects[1].Instances))
+	}
+	for i, expected := range []struct {
+		name  string
+		value int64
+	}{{"Idle", 0}, {"svchost", 928}} {
+		inst := objects[1].Instances[i]
+		if inst.Name != expected.name || inst.Counters[0].Value != expected.value {
+			t.Errorf("unexpected instance %q = %d", inst.Name, inst.Counters[0].Value)
+		}
+	}
+}
+
+func TestParsePerformanceDataNoInstances(t *testing.T) {
+	b := perflibtest.New()
+	web := b.AddObject(2916)
+	web.AddCounter(2918, 0x00010100, 8)
+	web.HasInstances = true
+
+	buffer := b.Bytes()
+
+	// An object with instances, but none at the moment, has no counter block
+	_, objects, err := ParsePerformanceData(buffer, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(objects) != 1 || len(objects[0].Instances) != 0 {
+		t.Fatalf("expected an object without instances, got %d objects", len(objects))
+	}
+
+	// NumInstances of the object, which is neither PERF_NO_INSTANCES nor a count
+	bo.PutUint32(buffer[int(bo.Uint32(buffer[24:]))+40:], uint32(0xfffffffe))
+
+	if _, _, err := ParsePerformanceData(buffer, nil, nil); err == nil {
+		t.Error("expected an error for a negative NumInstances other than PERF_NO_INSTANCES")
+	}
+}
+
+func TestParsePerformanceDataMalformed(t *testing.T) {
+	b := perflibtest.New()
+	process := b.AddObject(230)
+	process.AddCounter(784, 0x00010000, 4)
+	process.AddCounter(786, 0x00010100, 8)
+	process.AddInstance("Idle", 0, 1)
+	process.AddInstance("svchost", 928, 2)
+
+	buffer := b.Bytes()
+
+	// Truncating the buffer anywhere must return an error, not panic
+	for n := 0; n < len(buffer); n++ {
+		truncated := append([]byte{}, buffer[:n]...)
+
+		// Keep TotalByteLength consistent so the object parsers see the truncation
+		if n >= 24 {
+			bo.PutUint32(truncated[20:], uint32(n))
+		}
+
+		_, _, err := ParsePerformanceData(truncated, nil, nil)
+		if err == nil {
+			t.Fatalf("expected an error for a buffer truncated to %d bytes", n)
+		}
+		if _, ok := err.(*ParseError); !ok {
+			t.Fatalf("expected a *ParseError for %d bytes, got %T: %v", n, err, err)
+		}
+	}
+
+	corrupt := append([]byte{}, buffer...)
+	corrupt[0] = 'X'
+	if _, _, err := ParsePerformanceData(corrupt, nil, nil); err == nil {
+		t.Error("expected an error for an invalid signature")
+	}
+
+	corrupt = append([]byte{}, buffer...)
+	bo.PutUint32(corrupt[12:], 2)
+	if _, _, err := ParsePerformanceData(corrupt, nil, nil); err == nil {
+		t.Error("expected an error for an unknown version")
+	}
+
+	// CounterOffset of the second counter definition, pointing past the counter block
+	corrupt = append([]byte{}, buffer...)
+	bo.PutUint32(corrupt[int(bo.Uint32(buffer[24:]))+64+40+36:], 0xffff)
+
+	_, _, err := ParsePerformanceData(corrupt, nil, nil)
+	if perr, ok := err.(*ParseError); !ok || perr.Struct != "PERF_COUNTER_BLOCK" {
+		t.Errorf("expected a PERF_COUNTER_BLOCK error, got %v", err)
+	}
+}
+
+func TestParsePerformanceDataBigEndian(t *testing.T) {
+	b := perflibtest.New()
+	b.ByteOrder = binary.BigEndian
+
+	process := b.AddObject(230)
+	process.AddCounter(784, 0x00010000, 4)
+	process.AddCounter(786, 0x00010100, 8)
+	process.AddInstance("svchost", 928, 1<<40)
+
+	header, objects, err := ParsePerformanceData(b.Bytes(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if header.ByteOrder != binary.BigEndian || header.SystemName != "TESTHOST" {
+		t.Errorf("unexpected header %+v", header)
+	}
+
+	inst := objects[0].Instances[0]
+	if inst.Name != "svchost" || inst.Counters[0].Value != 928 || inst.Counters[1].Value != 1<<40 {
+		t.Errorf("unexpected instance %q = %d, %d", inst.Name, inst.Counters[0].Value, inst.Counters[1].Value)
+	}
+}
+
+func TestParsePerformanceDataElapsedTime(t *testing.T) {
+	const perfElapsedTime = 0x30240500
+
+	// Process start time and collection time as FILETIME, 90.5 seconds apart
+	b := perflibtest.New()
+
+	object := b.AddObject(230)
+	object.PerfTime = 131616922800000000
+	object.AddCounter(684, perfElapsedTime, 8)
+	object.AddInstance("svchost", 131616922800000000-905000000)
+
+	_, objects, err := ParsePerformanceData(b.Bytes(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	process := objects[0]
+	if process.PerfTime != 131616922800000000 || process.Frequency != 10000000 {
+		t.Errorf("unexpected time base %d / %d", process.PerfTime, process.Frequency)
+	}
+
+	if elapsed := process.ElapsedSeconds(process.Instances[0].Counters[0]); elapsed != 90.5 {
+		t.Errorf("expected 90.5s elapsed, got %v", elapsed)
+	}
+}
+
+func TestParsePerformanceDataBaseCounters(t *testing.T) {
+	const (
+		perfRawFraction = 0x20020400
+		perfRawBase     = 0x40030403
+	)
+
+	b := perflibtest.New()
+
+	memory := b.AddObject(4)
+	memory.AddCounter(1350, perfRawFraction, 4)
+	memory.AddCounter(1351, perfRawBase, 4)
+	memory.AddCounter(1352, 0x00010000, 4)
+	memory.SetValues(25, 200, 7)
+
+	_, objects, err := ParsePerformanceData(b.Bytes(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defs := objects[0].CounterDefs
+	if defs[0].Base != defs[1] {
+		t.Error("expected the fraction to be paired with the following base")
+	}
+	if defs[1].Base != nil || defs[2].Base != nil {
+		t.Error("expected no base for the base counter and the raw count")
+	}
+
+	counters := objects[0].Instances[0].Counters
+	if counters[0].Value != 25 || counters[0].BaseValue != 200 {
+		t.Errorf("unexpected fraction %d / %d", counters[0].Value, counters[0].BaseValue)
+	}
+}
+
+func TestParsePerformanceDataPrecisionTimer(t *testing.T) {
+	const (
+		perfCounterRawcount     = 0x00010000
+		perfPrecision100nsTimer = 0x20570500
+		perfPrecisionTimestamp  = 0x40030500
+	)
+
+	b := perflibtest.New()
+
+	adapter := b.AddObject(5000)
+	adapter.AddCounter(5002, perfCounterRawcount, 4)
+	adapter.AddCounter(5004, perfPrecision100nsTimer, 8)
+	adapter.AddCounter(5006, perfPrecisionTimestamp, 8)
+	adapter.SetValues(3, 5000000, 10000000)
+
+	_, objects, err := ParsePerformanceData(b.Bytes(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The precision timer's subtype (0x00070000) overlaps PERF_COUNTER_BASE
+	defs := objects[0].CounterDefs
+	if defs[0].IsBaseValue || defs[1].IsBaseValue || !defs[2].IsBaseValue {
+		t.Errorf("expected only the timestamp to be a base, got %v %v %v",
+			defs[0].IsBaseValue, defs[1].IsBaseValue, defs[2].IsBaseValue)
+	}
+	if defs[0].Base != nil || defs[1].Base != defs[2] {
+		t.Error("expected the timer to be paired with the timestamp")
+	}
+
+	counters := objects[0].Instances[0].Counters
+	if counters[1].Value != 5000000 || counters[1].BaseValue != 10000000 {
+		t.Errorf("unexpected timer %d / %d", counters[1].Value, counters[1].BaseValue)
+	}
+}
+
+func TestParsePerformanceDataInstances(t *testing.T) {
+	b := perflibtest.New()
+
+	memory := b.AddObject(4)
+	memory.AddCounter(1380, 0x00010100, 8)
+	memory.SetValues(1 << 30)
+
+	disk := b.AddObject(236)
+	disk.AddCounter(198, 0x00010000, 4)
+	disk.AddInstance("C:", 3)
+
+	web := b.AddObject(2916)
+	web.AddCounter(2918, 0x00010100, 8)
+	web.HasInstances = true
+
+	buffer := b.Bytes()
+
+	_, objects, err := ParsePerformanceData(buffer, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expected := range []struct {
+		hasInstances bool
+		instances    int
+	}{{false, 1}, {true, 1}, {true, 0}} {
+		o := objects[i]
+		if o.HasInstances != expected.hasInstances || len(o.Instances) != expected.instances {
+			t.Errorf("object %d: expected HasInstances %v and %d instances, got %v and %d",
+				o.NameIndex, expected.hasInstances, expected.instances, o.HasInstances, len(o.Instances))
+		}
+	}
+}
+
+func TestParsePerformanceDataValues(t *testing.T) {
+	b := perflibtest.New()
+	b.SystemName = "TÉSTHÖST"
+
+	process := b.AddObject(230)
+	process.AddCounter(784, 0x00010000, 4)
+	process.AddCounter(786, 0x00010100, 8)
+	process.AddInstance("svchost", 928, 1)
+	process.AddInstance("日本語 😀", 4, 2)
+
+	header, objects, err := ParsePerformanceData(b.Bytes(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if header.SystemName != "TÉSTHÖST" {
+		t.Errorf("unexpected system name %q", header.SystemName)
+	}
+	if name := objects[0].Instances[1].Name; name != "日本語 😀" {
+		t.Errorf("unexpected instance name %q", name)
+	}
+
+	for _, inst := range objects[0].Instances {
+		if len(inst.Values) != 2 || len(inst.Counters) != 2 {
+			t.Fatalf("expected 2 values, got %d", len(inst.Values))
+		}
+
+		for i := range inst.Values {
+			if inst.Counters[i] != &inst.Values[i] {
+				t.Errorf("counter %d of %q does not point into Values", i, inst.Name)
+			}
+		}
+	}
+
+	// Instances share a backing array, which must not leak through append
+	first := objects[0].Instances[0]
+	_ = append(first.Values, PerfCounter{Value: -1})
+	if objects[0].Instances[1].Values[0].Value != 4 {
+		t.Error("appending to Values modified the next instance")
+	}
+}
+
+var benchCapture = flag.String("perflib.capture", "",
+	"capture file (see tools/dump.go -w) to run the parser benchmarks against instead of a synthetic buffer")
+
+/*
+Returns the buffer and name tables to benchmark against. The synthetic buffer
+resembles a "Global" query on a busy machine, where Process and Thread account
+for most instances:
+
+	go test -bench Parse -benchmem ./perflib
+	go test -bench Parse -benchmem ./perflib -args -perflib.capture global.cap
+*/
+func benchmarkBuffer(b *testing.B) ([]byte, *NameTable, *NameTable) {
+	if *benchCapture != "" {
+		capture, err := ReadCaptureFile(*benchCapture)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		counterNames, helpNames, err := capture.NameTables()
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		return capture.Data, counterNames, helpNames
+	}
+
+	buffer := perflibtest.New()
+	names := make(map[uint32]string)
+
+	for _, o := range []struct {
+		index     uint32
+		counters  int
+		instances int
+	}{
+		{2, 18, 0},      // System
+		{4, 37, 0},      // Memory
+		{238, 15, 9},    // Processor
+		{236, 34, 4},    // LogicalDisk
+		{510, 22, 3},    // Network Interface
+		{230, 28, 300},  // Process
+		{232, 12, 4000}, // Thread
+		{4674, 32, 10},  // Processor Information
+	} {
+		object := buffer.AddObject(o.index)
+		names[o.index] = "Object"
+
+		values := make([]int64, o.counters)
+		for i := range values {
+			index := 10000 + o.index*100 + uint32(i)*2
+			names[index] = "Counter"
+
+			if i%2 == 0 {
+				object.AddCounter(index, 0x00010100, 8)
+			} else {
+				object.AddCounter(index, 0x10410400, 4)
+			}
+
+			values[i] = int64(i)
+		}
+
+		if o.instances == 0 {
+			object.SetValues(values...)
+		}
+
+		for i := 0; i < o.instances; i++ {
+			object.AddInstance("instance_"+string(rune('a'+i%26)), values...)
+		}
+	}
+
+	return buffer.Bytes(), NewNameTable(names), nil
+}
+
+func BenchmarkParsePerformanceData(b *testing.B) {
+	buffer, counterNames, helpNames := benchmarkBuffer(b)
+
+	b.SetBytes(int64(len(buffer)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		_, _, err := ParsePerformanceData(buffer, counterNames, helpNames)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
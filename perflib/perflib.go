@@ -27,9 +27,11 @@
 	Since Microsoft loves internalization, both names and help texts can be requested
 	any locally available language.
 
-	The library automatically loads the name tables and resolves all identifiers
-	in English ("Name" and "HelpText" struct members). You can manually resolve
-	identifiers in a different language by using the NameTable API.
+	The library loads the English name tables from the registry the first time
+	they're needed and resolves all identifiers in English ("Name" and "HelpText"
+	struct members). Use DefaultCounterNames and DefaultHelpNames to access them.
+	You can resolve identifiers in a different language by passing other name
+	tables in Options (see QueryLanguageNameTables and the NameTable API).
 
 	Performance Counters intro
 
@@ -111,24 +113,48 @@
 package perflib
 
 import (
-	"bytes"
 	"encoding/binary"
-	"fmt"
-	"io"
 	"sort"
-	"strings"
-	"syscall"
-	"unsafe"
+	"time"
 )
 
-// TODO: There's a LittleEndian field in the PERF header - we ought to check it
+// Byte order of the name tables. Performance data specifies its own byte order
+// in the PERF_DATA_BLOCK header.
 var bo = binary.LittleEndian
 
+/*
+English name tables, filled in the first time a query loads them (the zero
+value until then).
+
+Deprecated: they are written without synchronization while other goroutines
+may be reading them. Use DefaultCounterNames and DefaultHelpNames instead, which
+load the tables if necessary.
+*/
 var CounterNameTable NameTable
 var HelpNameTable NameTable
 
 const averageCount64Type = 1073874176
 
+// Global information about a performance data block, taken from its
+// PERF_DATA_BLOCK header.
+type PerfDataHeader struct {
+	// Name of the system the data was collected on
+	SystemName string
+
+	Version   uint32
+	Revision  uint32
+	ByteOrder binary.ByteOrder
+
+	// Time at the system under measurement, in UTC
+	SystemTime time.Time
+	// Performance counter value (in ticks of PerfFreq) at the time of collection
+	PerfTime int64
+	// Ticks per second of PerfTime
+	PerfFreq int64
+	// Time of collection in 100ns units (FILETIME)
+	PerfTime100nSec int64
+}
+
 // Top-level performance object (like "Process").
 type PerfObject struct {
 	Name string
@@ -139,9 +165,18 @@ type PerfObject struct {
 	Instances     []*PerfInstance
 	CounterDefs   []*PerfCounterDef
 
+	// Whether the object has instances (like Process), as opposed to objects
+	// like Memory, which are returned as a single instance without a name.
+	// Objects with instances may have any number of them, including none or one.
+	HasInstances bool
+
+	// Time base of the object's counters. PerfTime is the object's own timestamp
+	// in ticks of Frequency, which may differ from the data block's PerfTime
+	// (for example, Process uses 100ns FILETIME ticks).
+	PerfTime  int64
 	Frequency int64
 
-	rawData *perfObjectType
+	rawData perfObjectType
 }
 
 // Each object can have multiple instances. For example,
@@ -151,8 +186,9 @@ type PerfInstance struct {
 	Name     string
 	Counters []*PerfCounter
 
-	rawData         *perfInstanceDefinition
-	rawCounterBlock *perfCounterBlock
+	// Counter values, in the same order as the object's CounterDefs. Counters
+	// points into this array; iterating over Values avoids the indirection.
+	Values []PerfCounter
 }
 
 type PerfCounterDef struct {
@@ -174,6 +210,10 @@ type PerfCounterDef struct {
 	IsNanosecondCounter bool
 	HasSecondValue      bool
 
+	// Base counter (PERF_*_BASE) this counter is divided by, if any. By convention,
+	// the base definition immediately follows the counter it belongs to.
+	Base *PerfCounterDef
+
 	rawData *perfCounterDefinition
 }
 
@@ -181,134 +221,177 @@ type PerfCounter struct {
 	Value       int64
 	Def         *PerfCounterDef
 	SecondValue int64
+	// Value of the base counter, if Def.Base is set
+	BaseValue int64
 }
 
-// Error value returned by RegQueryValueEx if the buffer isn't sufficiently large
-const errorMoreData = syscall.Errno(234)
+/*
+Seconds elapsed between the start time stored in a PERF_ELAPSED_TIME counter
+and the time of collection. Both are measured in the object's time base
+(PerfTime and Frequency).
+*/
+func (o *PerfObject) ElapsedSeconds(counter *PerfCounter) float64 {
+	if o.Frequency == 0 {
+		return 0
+	}
+
+	return float64(o.PerfTime-counter.Value) / float64(o.Frequency)
+}
 
-var (
-	bufLenGlobal = uint32(400000)
-	bufLenCostly = uint32(2000000)
-)
+/*
+Query all performance counters that match a given query.
 
-// Queries the performance counter buffer using RegQueryValueEx, returning raw bytes. See:
-// https://msdn.microsoft.com/de-de/library/windows/desktop/aa373219(v=vs.85).aspx
-func queryRawData(query string) ([]byte, error) {
-	var (
-		valType uint32
-		buffer  []byte
-		bufLen  uint32
-	)
-
-	switch query {
-	case "Global":
-		bufLen = bufLenGlobal
-	case "Costly":
-		bufLen = bufLenCostly
-	default:
-		// TODO: depends on the number of values requested
-		// need make an educated guess
-		numCounters := len(strings.Split(query, " "))
-		bufLen = uint32(150000 * numCounters)
+The query can be any of the following:
+
+- "Global" (all performance counters except those Windows marked as costly)
+
+- "Costly" (only the costly ones)
+
+- One or more object indices, separated by spaces ("238 2 5")
+
+Many objects have dependencies - if you query one of them, you often get back
+more than you asked for.
+*/
+func QueryPerformanceData(query string) ([]*PerfObject, error) {
+	_, objects, err := QueryPerformanceDataWithHeader(query)
+	return objects, err
+}
+
+// Like QueryPerformanceData, but also returns the header of the data block.
+func QueryPerformanceDataWithHeader(query string) (*PerfDataHeader, []*PerfObject, error) {
+	snapshot, err := QueryWithOptions(query, nil)
+
+	if err != nil {
+		return nil, nil, err
 	}
 
-	buffer = make([]byte, bufLen)
+	return &snapshot.PerfDataHeader, snapshot.Objects, nil
+}
+
+// Options for QueryWithOptions. The zero value resolves names and help texts
+// using the English name tables.
+type Options struct {
+	// Name tables to resolve names and help texts with. If nil, the English
+	// tables ("Counter 009" and "Help 009") are loaded from the registry on first use.
+	CounterNames *NameTable
+	HelpNames    *NameTable
+
+	// Don't resolve help texts at all, which saves loading the (large) help table.
+	SkipHelpTexts bool
+}
+
+// Like QuerySnapshot, but with control over how names are resolved. opts may be nil.
+func QueryWithOptions(query string, opts *Options) (*Snapshot, error) {
+	if opts == nil {
+		opts = new(Options)
+	}
 
-	name, err := syscall.UTF16PtrFromString(query)
+	buffer, err := queryRawData(query)
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to encode query string: %v", err)
+		return nil, err
 	}
 
-	defer syscall.RegCloseKey(syscall.HKEY_PERFORMANCE_DATA)
-
-	for {
-		bufLen := uint32(len(buffer))
-
-		err := syscall.RegQueryValueEx(
-			syscall.HKEY_PERFORMANCE_DATA,
-			name,
-			nil,
-			&valType,
-			(*byte)(unsafe.Pointer(&buffer[0])),
-			&bufLen)
-
-		if err == errorMoreData {
-			newBuffer := make([]byte, len(buffer)+16384)
-			copy(newBuffer, buffer)
-			buffer = newBuffer
-			syscall.RegCloseKey(syscall.HKEY_PERFORMANCE_DATA)
-			continue
-		} else if err != nil {
-			if errno, ok := err.(syscall.Errno); ok {
-				return nil, fmt.Errorf("ReqQueryValueEx failed: %v errno %d", err, uint(errno))
-			}
+	counterNames := opts.CounterNames
+	helpNames := opts.HelpNames
 
+	if counterNames == nil {
+		counterNames, err = defaultNameTable("Counter 009")
+
+		if err != nil {
 			return nil, err
 		}
+	}
 
-		buffer = buffer[:bufLen]
+	if opts.SkipHelpTexts {
+		helpNames = nil
+	} else if helpNames == nil {
+		helpNames, err = defaultNameTable("Help 009")
 
-		switch query {
-		case "Global":
-			if bufLen > bufLenGlobal {
-				bufLenGlobal = bufLen
-			}
-		case "Costly":
-			if bufLen > bufLenCostly {
-				bufLenCostly = bufLen
-			}
+		if err != nil {
+			return nil, err
 		}
-
-		return buffer, nil
 	}
-}
 
-func init() {
-	// Initialize global name tables
-	// TODO: profiling, add option to disable name tables if necessary
-	// Not sure if we should resolve the names at all or just have the caller do it on demand
-	// (for many use cases the index is sufficient)
+	snapshot, err := ParseSnapshot(buffer, counterNames, helpNames)
 
-	CounterNameTable = *QueryNameTable("Counter 009")
-	HelpNameTable = *QueryNameTable("Help 009")
+	// The snapshot doesn't refer to the buffer, so it can be reused right away
+	releaseRawData(query, buffer)
+
+	return snapshot, err
 }
 
 /*
-Query all performance counters that match a given query.
+Parse a raw PERF_DATA_BLOCK, as returned by RegQueryValueEx on HKEY_PERFORMANCE_DATA.
 
-The query can be any of the following:
+Names and help texts are resolved using the given name tables. Either of them
+may be nil, in which case only the indices are filled in. This works on any
+platform, so buffers captured on a Windows machine can be analyzed elsewhere.
 
-- "Global" (all performance counters except those Windows marked as costly)
+Structures are decoded straight from the buffer. Instances and counter values
+of each object are allocated in bulk, so the number of allocations depends on
+the number of objects and instances, not on the number of counters.
+*/
+func ParsePerformanceData(buffer []byte, counterNames, helpNames *NameTable) (*PerfDataHeader, []*PerfObject, error) {
+	if len(buffer) < perfDataBlockSize {
+		return nil, nil, parseErrorf(0, "PERF_DATA_BLOCK", "buffer too short (%d bytes)", len(buffer))
+	}
 
-- "Costly" (only the costly ones)
+	// The LittleEndian field is either 0 or 1, so it reads the same in both byte orders
+	var order binary.ByteOrder = binary.BigEndian
 
-- One or more object indices, separated by spaces ("238 2 5")
+	if binary.LittleEndian.Uint32(buffer[8:12]) != 0 {
+		order = binary.LittleEndian
+	}
 
-Many objects have dependencies - if you query one of them, you often get back
-more than you asked for.
-*/
-func QueryPerformanceData(query string) ([]*PerfObject, error) {
-	buffer, err := queryRawData(query)
+	// Read global header
 
-	if err != nil {
-		return nil, err
+	var header perfDataBlock
+	header.decode(buffer, order)
+
+	// Check for "PERF" signature
+	if header.Signature != [4]uint16{80, 69, 82, 70} {
+		return nil, nil, parseErrorf(0, "PERF_DATA_BLOCK", "invalid signature %v", header.Signature)
 	}
 
-	r := bytes.NewReader(buffer)
+	if header.Version != perfDataVersion {
+		return nil, nil, parseErrorf(0, "PERF_DATA_BLOCK",
+			"unsupported version %d (revision %d)", header.Version, header.Revision)
+	}
 
-	// Read global header
+	switch {
+	case int64(header.TotalByteLength) > int64(len(buffer)):
+		return nil, nil, parseErrorf(0, "PERF_DATA_BLOCK",
+			"TotalByteLength %d exceeds buffer length %d", header.TotalByteLength, len(buffer))
+	case header.HeaderLength < perfDataBlockSize || header.HeaderLength > header.TotalByteLength:
+		return nil, nil, parseErrorf(0, "PERF_DATA_BLOCK",
+			"HeaderLength %d out of range (TotalByteLength %d)", header.HeaderLength, header.TotalByteLength)
+	case int64(header.NumObjectTypes)*perfObjectTypeSize > int64(header.TotalByteLength-header.HeaderLength):
+		return nil, nil, parseErrorf(0, "PERF_DATA_BLOCK",
+			"NumObjectTypes %d does not fit into TotalByteLength %d", header.NumObjectTypes, header.TotalByteLength)
+	case int64(header.SystemNameOffset)+int64(header.SystemNameLength) > int64(header.HeaderLength):
+		return nil, nil, parseErrorf(0, "PERF_DATA_BLOCK",
+			"system name (SystemNameOffset %d, SystemNameLength %d) exceeds HeaderLength %d",
+			header.SystemNameOffset, header.SystemNameLength, header.HeaderLength)
+	}
 
-	header := new(perfDataBlock)
-	err = header.BinaryReadFrom(r)
+	// Anything past TotalByteLength is unused buffer space
+	buffer = buffer[:header.TotalByteLength]
 
-	if err != nil {
-		return nil, err
-	}
+	systemName := decodeUTF16(buffer[header.SystemNameOffset:header.SystemNameOffset+header.SystemNameLength], order)
 
-	// Check for "PERF" signature
-	if header.Signature != [4]uint16{80, 69, 82, 70} {
-		panic("Invalid performance block header")
+	st := header.SystemTime
+
+	dataHeader := &PerfDataHeader{
+		SystemName: systemName,
+		Version:    header.Version,
+		Revision:   header.Revision,
+		ByteOrder:  order,
+		SystemTime: time.Date(int(st.Year), time.Month(st.Month), int(st.Day),
+			int(st.Hour), int(st.Minute), int(st.Second), int(st.Milliseconds)*int(time.Millisecond), time.UTC),
+		PerfTime:        header.PerfTime,
+		PerfFreq:        header.PerfFreq,
+		PerfTime100nSec: header.PerfTime100nSec,
 	}
 
 	// Parse the performance data
@@ -319,124 +402,221 @@ func QueryPerformanceData(query string) ([]*PerfObject, error) {
 	objOffset := int64(header.HeaderLength)
 
 	for i := 0; i < numObjects; i++ {
-		r.Seek(objOffset, io.SeekStart)
+		object, err := parseObject(buffer, order, objOffset, counterNames, helpNames)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		objects[i] = object
+
+		// Next perfObjectType
+		objOffset += int64(object.rawData.TotalByteLength)
+	}
+
+	return dataHeader, objects, nil
+}
+
+func parseObject(buffer []byte, order binary.ByteOrder, objOffset int64, counterNames, helpNames *NameTable) (*PerfObject, error) {
+	if objOffset+perfObjectTypeSize > int64(len(buffer)) {
+		return nil, parseErrorf(objOffset, "PERF_OBJECT_TYPE", "truncated object header")
+	}
+
+	object := new(PerfObject)
+	obj := &object.rawData
+	obj.decode(buffer[objOffset:], order)
+
+	objEnd := objOffset + int64(obj.TotalByteLength)
+
+	switch {
+	case objEnd > int64(len(buffer)):
+		return nil, parseErrorf(objOffset, "PERF_OBJECT_TYPE",
+			"TotalByteLength %d exceeds buffer length %d", obj.TotalByteLength, len(buffer))
+	case obj.HeaderLength < perfObjectTypeSize:
+		return nil, parseErrorf(objOffset, "PERF_OBJECT_TYPE", "HeaderLength %d too short", obj.HeaderLength)
+	case obj.DefinitionLength < obj.HeaderLength || obj.DefinitionLength > obj.TotalByteLength:
+		return nil, parseErrorf(objOffset, "PERF_OBJECT_TYPE",
+			"DefinitionLength %d out of range (HeaderLength %d, TotalByteLength %d)",
+			obj.DefinitionLength, obj.HeaderLength, obj.TotalByteLength)
+	case int64(obj.NumCounters)*perfCounterDefinitionSize > int64(obj.DefinitionLength-obj.HeaderLength):
+		return nil, parseErrorf(objOffset, "PERF_OBJECT_TYPE",
+			"NumCounters %d does not fit into DefinitionLength %d", obj.NumCounters, obj.DefinitionLength)
+	case int64(obj.NumInstances)*(perfInstanceDefinitionSize+perfCounterBlockSize) > int64(obj.TotalByteLength-obj.DefinitionLength):
+		return nil, parseErrorf(objOffset, "PERF_OBJECT_TYPE",
+			"NumInstances %d does not fit into TotalByteLength %d", obj.NumInstances, obj.TotalByteLength)
+	case obj.NumInstances < 0 && obj.NumInstances != perfNoInstances:
+		return nil, parseErrorf(objOffset, "PERF_OBJECT_TYPE", "invalid NumInstances %d", obj.NumInstances)
+	}
+
+	numCounterDefs := int(obj.NumCounters)
+	numInstances := int(obj.NumInstances)
+
+	// Perf objects can have no instances. The perflib differentiates
+	// between objects with instances and without, but we just create
+	// an empty instance in order to simplify the interface.
+	object.HasInstances = obj.NumInstances != perfNoInstances
 
-		obj := new(perfObjectType)
-		obj.BinaryReadFrom(r)
+	if !object.HasInstances {
+		numInstances = 1
+	}
+
+	object.Name = counterNames.LookupString(obj.ObjectNameTitleIndex)
+	object.NameIndex = uint(obj.ObjectNameTitleIndex)
+	object.HelpText = helpNames.LookupString(obj.ObjectHelpTitleIndex)
+	object.HelpTextIndex = uint(obj.ObjectHelpTitleIndex)
+	object.PerfTime = obj.PerfTime
+	object.Frequency = obj.PerfFreq
+
+	// Counter definitions, instances and counter values are each allocated in one go
+	defs := make([]PerfCounterDef, numCounterDefs)
+	rawDefs := make([]perfCounterDefinition, numCounterDefs)
+	object.CounterDefs = make([]*PerfCounterDef, numCounterDefs)
+
+	instances := make([]PerfInstance, numInstances)
+	object.Instances = make([]*PerfInstance, numInstances)
 
-		numCounterDefs := int(obj.NumCounters)
-		numInstances := int(obj.NumInstances)
+	values := make([]PerfCounter, numInstances*numCounterDefs)
+	counters := make([]*PerfCounter, numInstances*numCounterDefs)
 
-		// Perf objects can have no instances. The perflib differentiates
-		// between objects with instances and without, but we just create
-		// an empty instance in order to simplify the interface.
-		if numInstances <= 0 {
-			numInstances = 1
+	defOffset := objOffset + int64(obj.HeaderLength)
+	defEnd := objOffset + int64(obj.DefinitionLength)
+
+	for i := 0; i < numCounterDefs; i++ {
+		if defOffset+perfCounterDefinitionSize > defEnd {
+			return nil, parseErrorf(defOffset, "PERF_COUNTER_DEFINITION",
+				"counter definition %d exceeds DefinitionLength %d", i, obj.DefinitionLength)
 		}
 
-		instances := make([]*PerfInstance, numInstances)
-		counterDefs := make([]*PerfCounterDef, numCounterDefs)
-
-		objects[i] = &PerfObject{
-			Name:          obj.LookupName(),
-			NameIndex:     uint(obj.ObjectNameTitleIndex),
-			HelpText:      obj.LookupHelp(),
-			HelpTextIndex: uint(obj.ObjectHelpTitleIndex),
-			Instances:     instances,
-			CounterDefs:   counterDefs,
-			Frequency:     obj.PerfFreq,
-			rawData:       obj,
+		def := &rawDefs[i]
+		def.decode(buffer[defOffset:], order)
+
+		if def.ByteLength < perfCounterDefinitionSize {
+			return nil, parseErrorf(defOffset, "PERF_COUNTER_DEFINITION", "ByteLength %d too short", def.ByteLength)
 		}
 
-		for i := 0; i < numCounterDefs; i++ {
-			def := new(perfCounterDefinition)
-			def.BinaryReadFrom(r)
+		defs[i] = PerfCounterDef{
+			Name:          counterNames.LookupString(def.CounterNameTitleIndex),
+			NameIndex:     uint(def.CounterNameTitleIndex),
+			HelpText:      helpNames.LookupString(def.CounterHelpTitleIndex),
+			HelpTextIndex: uint(def.CounterHelpTitleIndex),
+			rawData:       def,
 
-			counterDefs[i] = &PerfCounterDef{
-				Name:          def.LookupName(),
-				NameIndex:     uint(def.CounterNameTitleIndex),
-				HelpText:      def.LookupHelp(),
-				HelpTextIndex: uint(def.CounterHelpTitleIndex),
-				rawData:       def,
+			CounterType: def.CounterType,
 
-				CounterType: def.CounterType,
+			IsCounter:           def.CounterType&0x400 == 0x400,
+			IsBaseValue:         def.CounterType&0x00070000 == 0x00030000,
+			IsNanosecondCounter: def.CounterType&0x00100000 == 0x00100000,
+			HasSecondValue:      def.CounterType == averageCount64Type,
+		}
 
-				IsCounter:           def.CounterType&0x400 == 0x400,
-				IsBaseValue:         def.CounterType&0x00030000 == 0x00030000,
-				IsNanosecondCounter: def.CounterType&0x00100000 == 0x00100000,
-				HasSecondValue:      def.CounterType == averageCount64Type,
-			}
+		object.CounterDefs[i] = &defs[i]
+		defOffset += int64(def.ByteLength)
+	}
+
+	for i := 0; i+1 < numCounterDefs; i++ {
+		if !defs[i].IsBaseValue && defs[i+1].IsBaseValue {
+			defs[i].Base = &defs[i+1]
 		}
+	}
+
+	pos := objOffset + int64(obj.DefinitionLength)
 
-		if obj.NumInstances <= 0 {
-			blockOffset := objOffset + int64(obj.DefinitionLength)
-			r.Seek(blockOffset, io.SeekStart)
+	for i := 0; i < numInstances; i++ {
+		instance := &instances[i]
+		object.Instances[i] = instance
 
-			_, counters := parseCounterBlock(buffer, r, blockOffset, counterDefs)
+		instance.Values = values[i*numCounterDefs : (i+1)*numCounterDefs : (i+1)*numCounterDefs]
+		instance.Counters = counters[i*numCounterDefs : (i+1)*numCounterDefs : (i+1)*numCounterDefs]
 
-			instances[0] = &PerfInstance{
-				Name:            "",
-				Counters:        counters,
-				rawData:         nil,
-				rawCounterBlock: nil,
+		for j := range instance.Values {
+			instance.Counters[j] = &instance.Values[j]
+		}
+
+		if object.HasInstances {
+			if pos+perfInstanceDefinitionSize > objEnd {
+				return nil, parseErrorf(pos, "PERF_INSTANCE_DEFINITION",
+					"instance %d exceeds TotalByteLength %d", i, obj.TotalByteLength)
 			}
-		} else {
-			instOffset := objOffset + int64(obj.DefinitionLength)
 
-			for i := 0; i < numInstances; i++ {
-				r.Seek(instOffset, io.SeekStart)
+			var inst perfInstanceDefinition
+			inst.decode(buffer[pos:], order)
+
+			switch {
+			case inst.ByteLength < perfInstanceDefinitionSize || pos+int64(inst.ByteLength) > objEnd:
+				return nil, parseErrorf(pos, "PERF_INSTANCE_DEFINITION",
+					"ByteLength %d out of range", inst.ByteLength)
+			case int64(inst.NameOffset)+int64(inst.NameLength) > int64(inst.ByteLength):
+				return nil, parseErrorf(pos, "PERF_INSTANCE_DEFINITION",
+					"name (NameOffset %d, NameLength %d) exceeds ByteLength %d",
+					inst.NameOffset, inst.NameLength, inst.ByteLength)
+			}
 
-				inst := new(perfInstanceDefinition)
-				inst.BinaryReadFrom(r)
+			nameOffset := pos + int64(inst.NameOffset)
+			instance.Name = decodeUTF16(buffer[nameOffset:nameOffset+int64(inst.NameLength)], order)
 
-				name, _ := readUTF16StringAtPos(r, instOffset+int64(inst.NameOffset), inst.NameLength)
-				pos := instOffset + int64(inst.ByteLength)
-				offset, counters := parseCounterBlock(buffer, r, pos, counterDefs)
+			pos += int64(inst.ByteLength)
+		}
 
-				instances[i] = &PerfInstance{
-					Name:     name,
-					Counters: counters,
-					rawData:  inst,
-				}
+		length, err := parseCounterBlock(buffer, order, pos, objEnd, defs, instance.Values)
 
-				instOffset = pos + offset
-			}
+		if err != nil {
+			return nil, err
 		}
 
-		// Next perfObjectType
-		objOffset += int64(obj.TotalByteLength)
+		pos += length
 	}
 
-	return objects, nil
+	return object, nil
 }
 
-func parseCounterBlock(b []byte, r io.ReadSeeker, pos int64, defs []*PerfCounterDef) (int64, []*PerfCounter) {
-	r.Seek(pos, io.SeekStart)
-	block := new(perfCounterBlock)
-	block.BinaryReadFrom(r)
+// Decode a PERF_COUNTER_BLOCK into values, which has one entry per definition.
+// Returns the length of the block.
+func parseCounterBlock(b []byte, order binary.ByteOrder, pos int64, end int64, defs []PerfCounterDef, values []PerfCounter) (int64, error) {
+	if pos+perfCounterBlockSize > end {
+		return 0, parseErrorf(pos, "PERF_COUNTER_BLOCK", "truncated counter block")
+	}
+
+	var block perfCounterBlock
+	block.decode(b[pos:], order)
+
+	if block.ByteLength < perfCounterBlockSize || pos+int64(block.ByteLength) > end {
+		return 0, parseErrorf(pos, "PERF_COUNTER_BLOCK", "ByteLength %d out of range", block.ByteLength)
+	}
 
-	counters := make([]*PerfCounter, len(defs))
+	for i := range defs {
+		def := &defs[i]
+		valueEnd := int64(def.rawData.CounterOffset) + int64(def.rawData.CounterSize)
+
+		if def.HasSecondValue {
+			valueEnd += 8
+		}
+
+		if valueEnd > int64(block.ByteLength) {
+			return 0, parseErrorf(pos, "PERF_COUNTER_BLOCK",
+				"counter %d (CounterOffset %d, CounterSize %d) exceeds ByteLength %d",
+				def.NameIndex, def.rawData.CounterOffset, def.rawData.CounterSize, block.ByteLength)
+		}
 
-	for i, def := range defs {
 		valueOffset := pos + int64(def.rawData.CounterOffset)
-		value := convertCounterValue(def.rawData, b, valueOffset)
-		secondValue := int64(0)
+
+		values[i].Def = def
+		values[i].Value = convertCounterValue(def.rawData, order, b, valueOffset)
 
 		if def.HasSecondValue {
-			secondValue = convertCounterValue(def.rawData, b, valueOffset+8)
+			values[i].SecondValue = convertCounterValue(def.rawData, order, b, valueOffset+8)
 		}
+	}
 
-		counters[i] = &PerfCounter{
-			Value:       value,
-			Def:         def,
-			SecondValue: secondValue,
+	for i := range defs {
+		if defs[i].Base != nil {
+			values[i].BaseValue = values[i+1].Value
 		}
 	}
 
-	return int64(block.ByteLength), counters
+	return int64(block.ByteLength), nil
 }
 
-func convertCounterValue(counterDef *perfCounterDefinition, buffer []byte, valueOffset int64) (value int64) {
+func convertCounterValue(counterDef *perfCounterDefinition, order binary.ByteOrder, buffer []byte, valueOffset int64) (value int64) {
 	/*
 		We can safely ignore the type since we're not interested in anything except the raw value.
 		We also ignore all of the other attributes (timestamp, presentation, multi counter values...)
@@ -450,15 +630,18 @@ func convertCounterValue(counterDef *perfCounterDefinition, buffer []byte, value
 			272696320	32bit rate
 			272696576	64bit rate
 
+		The caller is responsible for checking that CounterSize bytes are
+		available at valueOffset.
 	*/
 
-	switch counterDef.CounterSize {
-	case 4:
-		value = int64(bo.Uint32(buffer[valueOffset:(valueOffset + 4)]))
-	case 8:
-		value = int64(bo.Uint64(buffer[valueOffset:(valueOffset + 8)]))
+	switch {
+	case counterDef.CounterSize == 8:
+		value = int64(order.Uint64(buffer[valueOffset:(valueOffset + 8)]))
+	case counterDef.CounterSize >= 4:
+		value = int64(order.Uint32(buffer[valueOffset:(valueOffset + 4)]))
 	default:
-		value = int64(bo.Uint32(buffer[valueOffset:(valueOffset + 4)]))
+		// Zero-length counters (PERF_COUNTER_NODATA) have no value
+		value = 0
 	}
 
 	return
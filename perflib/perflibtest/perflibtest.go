@@ -0,0 +1,335 @@
+/*
+Package perflibtest builds synthetic perflib buffers for tests.
+
+The buffers are laid out exactly like the ones returned by RegQueryValueEx on
+HKEY_PERFORMANCE_DATA, so they can be passed to perflib.ParsePerformanceData
+and friends on any platform:
+
+	b := perflibtest.New()
+	process := b.AddObject(230)
+	process.AddCounter(784, 0x00010000, 4) // ID Process
+	process.AddInstance("svchost", 928)
+
+	objects, err := perflib.ParsePerformanceData(b.Bytes(), nil, nil)
+*/
+package perflibtest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf16"
+)
+
+// A PERF_DATA_BLOCK under construction.
+type Buffer struct {
+	SystemName string
+	// Defaults to little endian. The LittleEndian header field is set accordingly.
+	ByteOrder binary.ByteOrder
+
+	Version  uint32
+	Revision uint32
+
+	SystemTime      time.Time
+	PerfTime        int64
+	PerfFreq        int64
+	PerfTime100nSec int64
+
+	Objects []*Object
+}
+
+// A PERF_OBJECT_TYPE. Objects without any instances are serialized with
+// NumInstances = PERF_NO_INSTANCES, using Values for their counter block,
+// unless HasInstances is set.
+type Object struct {
+	NameIndex uint32
+	HelpIndex uint32
+
+	// Set by AddInstance. Set it explicitly for an object which has instances,
+	// but none at the moment (NumInstances = 0).
+	HasInstances bool
+
+	PerfTime int64
+	PerfFreq int64
+
+	Counters  []*Counter
+	Instances []*Instance
+	Values    []int64
+}
+
+// A PERF_COUNTER_DEFINITION. Offset is relative to the start of the counter block.
+type Counter struct {
+	NameIndex uint32
+	HelpIndex uint32
+	Type      uint32
+	Size      uint32
+	Offset    uint32
+}
+
+// A PERF_INSTANCE_DEFINITION along with its counter block. Values are in the
+// same order as the object's counters.
+type Instance struct {
+	Name   string
+	Values []int64
+}
+
+// Size of PERF_COUNTER_BLOCK, after which counter values start
+const counterBlockHeaderSize = 8
+
+// Returns an empty buffer with plausible defaults for the header.
+func New() *Buffer {
+	return &Buffer{
+		SystemName:      "TESTHOST",
+		ByteOrder:       binary.LittleEndian,
+		Version:         1,
+		Revision:        1,
+		SystemTime:      time.Date(2018, 1, 28, 22, 18, 0, 0, time.UTC),
+		PerfTime:        50000000,
+		PerfFreq:        10000000,
+		PerfTime100nSec: 131616922800000000,
+	}
+}
+
+// Add an object. Its help index defaults to nameIndex + 1, like Windows does,
+// and it uses the data block's time base.
+func (b *Buffer) AddObject(nameIndex uint32) *Object {
+	o := &Object{
+		NameIndex: nameIndex,
+		HelpIndex: nameIndex + 1,
+		PerfTime:  b.PerfTime,
+		PerfFreq:  b.PerfFreq,
+	}
+
+	b.Objects = append(b.Objects, o)
+	return o
+}
+
+// Add a counter definition of the given type and size (4 or 8 bytes, or 0 for
+// PERF_COUNTER_NODATA). It is placed after all previously added counters.
+func (o *Object) AddCounter(nameIndex, counterType, size uint32) *Counter {
+	offset := uint32(counterBlockHeaderSize)
+
+	for _, c := range o.Counters {
+		if end := c.Offset + c.Size; end > offset {
+			offset = end
+		}
+	}
+
+	c := &Counter{
+		NameIndex: nameIndex,
+		HelpIndex: nameIndex + 1,
+		Type:      counterType,
+		Size:      size,
+		Offset:    offset,
+	}
+
+	o.Counters = append(o.Counters, c)
+	return c
+}
+
+// Add an instance with one value per counter.
+func (o *Object) AddInstance(name string, values ...int64) *Instance {
+	i := &Instance{Name: name, Values: values}
+	o.Instances = append(o.Instances, i)
+	o.HasInstances = true
+	return i
+}
+
+// Set the counter values of an object without instances.
+func (o *Object) SetValues(values ...int64) {
+	o.Values = values
+}
+
+// Serialize the buffer.
+func (b *Buffer) Bytes() []byte {
+	order := b.byteOrder()
+
+	var body []byte
+	for _, o := range b.Objects {
+		body = append(body, o.bytes(order)...)
+	}
+
+	name := utf16Bytes(order, b.SystemName)
+	headerLength := 88 + len(pad8(name))
+
+	littleEndian := uint32(0)
+	if order == binary.LittleEndian {
+		littleEndian = 1
+	}
+
+	st := b.SystemTime
+
+	header := new(bytes.Buffer)
+	write(header, order,
+		[4]uint16{'P', 'E', 'R', 'F'},
+		littleEndian,
+		b.Version,
+		b.Revision,
+		uint32(headerLength+len(body)),
+		uint32(headerLength),
+		uint32(len(b.Objects)),
+		int32(-1), // DefaultObject
+		[8]uint16{
+			uint16(st.Year()), uint16(st.Month()), uint16(st.Weekday()), uint16(st.Day()),
+			uint16(st.Hour()), uint16(st.Minute()), uint16(st.Second()), uint16(st.Nanosecond() / 1e6),
+		},
+		uint32(0), // alignment padding
+		b.PerfTime,
+		b.PerfFreq,
+		b.PerfTime100nSec,
+		uint32(len(name)),
+		uint32(88),
+	)
+
+	return append(append(header.Bytes(), pad8(name)...), body...)
+}
+
+func (b *Buffer) byteOrder() binary.ByteOrder {
+	if b.ByteOrder == nil {
+		return binary.LittleEndian
+	}
+
+	return b.ByteOrder
+}
+
+func (o *Object) bytes(order binary.ByteOrder) []byte {
+	defs := new(bytes.Buffer)
+
+	for _, c := range o.Counters {
+		write(defs, order,
+			uint32(40), // ByteLength
+			c.NameIndex,
+			uint32(0), // CounterNameTitle
+			c.HelpIndex,
+			uint32(0), // CounterHelpTitle
+			int32(0),  // DefaultScale
+			uint32(100),
+			c.Type,
+			c.Size,
+			c.Offset,
+		)
+	}
+
+	var data []byte
+	numInstances := int32(-1)
+
+	if !o.HasInstances {
+		data = o.counterBlock(order, o.Values)
+	} else {
+		numInstances = int32(len(o.Instances))
+
+		for _, inst := range o.Instances {
+			name := utf16Bytes(order, inst.Name)
+
+			def := new(bytes.Buffer)
+			write(def, order,
+				uint32(24+len(pad8(name))), // ByteLength
+				uint32(0),                  // ParentObjectTitleIndex
+				uint32(0),                  // ParentObjectInstance
+				int32(-1),                  // UniqueID (PERF_NO_UNIQUE_ID)
+				uint32(24),                 // NameOffset
+				uint32(len(name)),
+			)
+
+			data = append(data, def.Bytes()...)
+			data = append(data, pad8(name)...)
+			data = append(data, o.counterBlock(order, inst.Values)...)
+		}
+	}
+
+	header := new(bytes.Buffer)
+	write(header, order,
+		uint32(64+defs.Len()+len(data)), // TotalByteLength
+		uint32(64+defs.Len()),           // DefinitionLength
+		uint32(64),                      // HeaderLength
+		o.NameIndex,
+		uint32(0), // ObjectNameTitle
+		o.HelpIndex,
+		uint32(0),   // ObjectHelpTitle
+		uint32(100), // DetailLevel (PERF_DETAIL_NOVICE)
+		uint32(len(o.Counters)),
+		int32(-1), // DefaultCounter
+		numInstances,
+		uint32(0), // CodePage
+		o.PerfTime,
+		o.PerfFreq,
+	)
+
+	return append(append(header.Bytes(), defs.Bytes()...), data...)
+}
+
+func (o *Object) counterBlock(order binary.ByteOrder, values []int64) []byte {
+	length := uint32(counterBlockHeaderSize)
+
+	for _, c := range o.Counters {
+		if end := c.Offset + c.Size; end > length {
+			length = end
+		}
+	}
+
+	data := make([]byte, length)
+
+	for i, c := range o.Counters {
+		if i >= len(values) {
+			break
+		}
+
+		switch c.Size {
+		case 4:
+			order.PutUint32(data[c.Offset:], uint32(values[i]))
+		case 8:
+			order.PutUint64(data[c.Offset:], uint64(values[i]))
+		}
+	}
+
+	data = pad8(data)
+	order.PutUint32(data, uint32(len(data)))
+
+	return data
+}
+
+/*
+Serialize a name table, as returned by RegQueryValueEx for "Counter 009" or
+"Help 009": alternating, null-terminated UTF-16 index and name strings.
+*/
+func NameTable(entries map[uint32]string) []byte {
+	indices := make([]uint32, 0, len(entries))
+	for i := range entries {
+		indices = append(indices, i)
+	}
+
+	sort.Slice(indices, func(i, j int) bool {
+		return indices[i] < indices[j]
+	})
+
+	var b []byte
+	for _, i := range indices {
+		b = append(b, utf16Bytes(binary.LittleEndian, strconv.Itoa(int(i)))...)
+		b = append(b, utf16Bytes(binary.LittleEndian, entries[i])...)
+	}
+
+	return b
+}
+
+func write(b *bytes.Buffer, order binary.ByteOrder, fields ...interface{}) {
+	for _, f := range fields {
+		// Writing fixed-size values to a bytes.Buffer can't fail
+		_ = binary.Write(b, order, f)
+	}
+}
+
+// Null-terminated UTF-16
+func utf16Bytes(order binary.ByteOrder, s string) []byte {
+	b := new(bytes.Buffer)
+	write(b, order, append(utf16.Encode([]rune(s)), 0))
+	return b.Bytes()
+}
+
+func pad8(b []byte) []byte {
+	for len(b)%8 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
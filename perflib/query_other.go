@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package perflib
+
+import "errors"
+
+// HKEY_PERFORMANCE_DATA only exists on Windows. Everywhere else, the package
+// can still parse buffers that were obtained some other way.
+func (p *bufferPool) queryRegistry(query string) ([]byte, error) {
+	return nil, errors.New("perflib: HKEY_PERFORMANCE_DATA is only available on Windows")
+}
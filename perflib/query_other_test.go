@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package perflib
+
+import "testing"
+
+func TestQueryWithOptionsUnsupported(t *testing.T) {
+	// Neither the query nor the name tables can be loaded, but that must not panic
+	_, err := QueryWithOptions("Global", &Options{SkipHelpTexts: true})
+	if err == nil {
+		t.Fatal("expected an error off Windows")
+	}
+
+	if _, err := DefaultCounterNames(); err == nil {
+		t.Error("expected an error loading the default name table")
+	}
+	if defaultCounterNames != nil || CounterNameTable.byIndex != nil {
+		t.Error("a failed load must leave the default name table empty")
+	}
+
+	if _, err := defaultNameTable("Counter 007"); err == nil {
+		t.Error("expected an error for a non-default name table")
+	}
+}
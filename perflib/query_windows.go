@@ -0,0 +1,65 @@
+//go:build windows
+// +build windows
+
+package perflib
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// Error value returned by RegQueryValueEx if the buffer isn't sufficiently large
+const errorMoreData = syscall.Errno(234)
+
+// Queries the performance counter buffer using RegQueryValueEx, returning raw bytes. See:
+// https://msdn.microsoft.com/de-de/library/windows/desktop/aa373219(v=vs.85).aspx
+//
+// The buffer comes from the pool. Callers may hand it back using put once
+// they're done with it.
+func (p *bufferPool) queryRegistry(query string) ([]byte, error) {
+	var valType uint32
+
+	name, err := syscall.UTF16PtrFromString(query)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode query string: %v", err)
+	}
+
+	buffer := p.get(query)
+
+	defer syscall.RegCloseKey(syscall.HKEY_PERFORMANCE_DATA)
+
+	for {
+		bufLen := uint32(len(buffer))
+
+		err := syscall.RegQueryValueEx(
+			syscall.HKEY_PERFORMANCE_DATA,
+			name,
+			nil,
+			&valType,
+			(*byte)(unsafe.Pointer(&buffer[0])),
+			&bufLen)
+
+		if err == errorMoreData {
+			buffer, err = p.grow(buffer)
+
+			if err != nil {
+				return nil, err
+			}
+
+			syscall.RegCloseKey(syscall.HKEY_PERFORMANCE_DATA)
+			continue
+		} else if err != nil {
+			if errno, ok := err.(syscall.Errno); ok {
+				return nil, fmt.Errorf("ReqQueryValueEx failed: %v errno %d", err, uint(errno))
+			}
+
+			return nil, err
+		}
+
+		p.done(query, int(bufLen))
+
+		return buffer[:bufLen], nil
+	}
+}
@@ -1,14 +1,30 @@
 package perflib
 
 import (
-	"syscall"
-	"io"
 	"encoding/binary"
 )
 
-type binaryReaderFrom interface {
-	BinaryReadFrom(r io.Reader) error
-}
+/*
+The structures below are decoded directly from the buffer, without going
+through encoding/binary's reflection. Each decode method expects at least the
+structure's on-disk size (see below) to be available in b; callers check this.
+*/
+
+// On-disk sizes of the fixed-length structures below
+const (
+	perfDataBlockSize          = 88
+	perfObjectTypeSize         = 64
+	perfCounterDefinitionSize  = 40
+	perfCounterBlockSize       = 4
+	perfInstanceDefinitionSize = 24
+)
+
+// PERF_DATA_VERSION from winperf.h, the only version we know how to parse
+const perfDataVersion = 1
+
+// NumInstances of objects which don't have instances, as opposed to 0 for
+// objects which have instances, but none at the moment
+const perfNoInstances = -1
 
 /*
 https://msdn.microsoft.com/de-de/library/windows/desktop/aa373157(v=vs.85).aspx
@@ -40,8 +56,8 @@ type perfDataBlock struct {
 	HeaderLength     uint32
 	NumObjectTypes   uint32
 	DefaultObject    int32
-	SystemTime       syscall.Systemtime
-	_                uint32 // TODO
+	SystemTime       systemTime
+	_                uint32 // alignment padding for PerfTime
 	PerfTime         int64
 	PerfFreq         int64
 	PerfTime100nSec  int64
@@ -49,8 +65,47 @@ type perfDataBlock struct {
 	SystemNameOffset uint32
 }
 
-func (p *perfDataBlock) BinaryReadFrom(r io.Reader) error {
-	return binary.Read(r, bo, p)
+// Same layout as SYSTEMTIME (syscall.Systemtime only exists on Windows)
+type systemTime struct {
+	Year         uint16
+	Month        uint16
+	DayOfWeek    uint16
+	Day          uint16
+	Hour         uint16
+	Minute       uint16
+	Second       uint16
+	Milliseconds uint16
+}
+
+func (p *perfDataBlock) decode(b []byte, order binary.ByteOrder) {
+	for i := range p.Signature {
+		p.Signature[i] = order.Uint16(b[i*2:])
+	}
+
+	p.LittleEndian = order.Uint32(b[8:])
+	p.Version = order.Uint32(b[12:])
+	p.Revision = order.Uint32(b[16:])
+	p.TotalByteLength = order.Uint32(b[20:])
+	p.HeaderLength = order.Uint32(b[24:])
+	p.NumObjectTypes = order.Uint32(b[28:])
+	p.DefaultObject = int32(order.Uint32(b[32:]))
+	p.SystemTime.decode(b[36:], order)
+	p.PerfTime = int64(order.Uint64(b[56:]))
+	p.PerfFreq = int64(order.Uint64(b[64:]))
+	p.PerfTime100nSec = int64(order.Uint64(b[72:]))
+	p.SystemNameLength = order.Uint32(b[80:])
+	p.SystemNameOffset = order.Uint32(b[84:])
+}
+
+func (t *systemTime) decode(b []byte, order binary.ByteOrder) {
+	t.Year = order.Uint16(b[0:])
+	t.Month = order.Uint16(b[2:])
+	t.DayOfWeek = order.Uint16(b[4:])
+	t.Day = order.Uint16(b[6:])
+	t.Hour = order.Uint16(b[8:])
+	t.Minute = order.Uint16(b[10:])
+	t.Second = order.Uint16(b[12:])
+	t.Milliseconds = order.Uint16(b[14:])
 }
 
 /*
@@ -91,8 +146,21 @@ type perfObjectType struct {
 	PerfFreq             int64
 }
 
-func (p *perfObjectType) BinaryReadFrom(r io.Reader) error {
-	return binary.Read(r, bo, p)
+func (p *perfObjectType) decode(b []byte, order binary.ByteOrder) {
+	p.TotalByteLength = order.Uint32(b[0:])
+	p.DefinitionLength = order.Uint32(b[4:])
+	p.HeaderLength = order.Uint32(b[8:])
+	p.ObjectNameTitleIndex = order.Uint32(b[12:])
+	p.ObjectNameTitle = order.Uint32(b[16:])
+	p.ObjectHelpTitleIndex = order.Uint32(b[20:])
+	p.ObjectHelpTitle = order.Uint32(b[24:])
+	p.DetailLevel = order.Uint32(b[28:])
+	p.NumCounters = order.Uint32(b[32:])
+	p.DefaultCounter = int32(order.Uint32(b[36:]))
+	p.NumInstances = int32(order.Uint32(b[40:]))
+	p.CodePage = order.Uint32(b[44:])
+	p.PerfTime = int64(order.Uint64(b[48:]))
+	p.PerfFreq = int64(order.Uint64(b[56:]))
 }
 
 /*
@@ -125,16 +193,17 @@ type perfCounterDefinition struct {
 	CounterOffset         uint32
 }
 
-func (p *perfCounterDefinition) BinaryReadFrom(r io.Reader) error {
-	return binary.Read(r, bo, p)
-}
-
-func (p *perfCounterDefinition) LookupName() string {
-	return CounterNameTable.LookupString(p.CounterNameTitleIndex)
-}
-
-func (p *perfCounterDefinition) LookupHelp() string {
-	return HelpNameTable.LookupString(p.CounterHelpTitleIndex)
+func (p *perfCounterDefinition) decode(b []byte, order binary.ByteOrder) {
+	p.ByteLength = order.Uint32(b[0:])
+	p.CounterNameTitleIndex = order.Uint32(b[4:])
+	p.CounterNameTitle = order.Uint32(b[8:])
+	p.CounterHelpTitleIndex = order.Uint32(b[12:])
+	p.CounterHelpTitle = order.Uint32(b[16:])
+	p.DefaultScale = int32(order.Uint32(b[20:]))
+	p.DetailLevel = order.Uint32(b[24:])
+	p.CounterType = order.Uint32(b[28:])
+	p.CounterSize = order.Uint32(b[32:])
+	p.CounterOffset = order.Uint32(b[36:])
 }
 
 /*
@@ -149,8 +218,8 @@ type perfCounterBlock struct {
 	ByteLength uint32
 }
 
-func (p *perfCounterBlock) BinaryReadFrom(r io.Reader) error {
-	return binary.Read(r, bo, p)
+func (p *perfCounterBlock) decode(b []byte, order binary.ByteOrder) {
+	p.ByteLength = order.Uint32(b[0:])
 }
 
 /*
@@ -175,6 +244,11 @@ type perfInstanceDefinition struct {
 	NameLength             uint32
 }
 
-func (p *perfInstanceDefinition) BinaryReadFrom(r io.Reader) error {
-	return binary.Read(r, bo, p)
+func (p *perfInstanceDefinition) decode(b []byte, order binary.ByteOrder) {
+	p.ByteLength = order.Uint32(b[0:])
+	p.ParentObjectTitleIndex = order.Uint32(b[4:])
+	p.ParentObjectInstance = order.Uint32(b[8:])
+	p.UniqueID = order.Uint32(b[12:])
+	p.NameOffset = order.Uint32(b[16:])
+	p.NameLength = order.Uint32(b[20:])
 }
@@ -0,0 +1,57 @@
+package perflib
+
+import "time"
+
+// A Snapshot is the result of a single query: all returned objects, along with
+// the time bases and the name of the machine they were collected on.
+//
+// Counters like PERF_COUNTER_COUNTER or PERF_COUNTER_TIMER only become meaningful
+// when comparing two snapshots, using the elapsed time between them.
+type Snapshot struct {
+	PerfDataHeader
+	Objects []*PerfObject
+}
+
+// Like QueryPerformanceData, but returns a Snapshot which retains the data block header.
+func QuerySnapshot(query string) (*Snapshot, error) {
+	return QueryWithOptions(query, nil)
+}
+
+// Like ParsePerformanceData, but returns a Snapshot.
+func ParseSnapshot(buffer []byte, counterNames, helpNames *NameTable) (*Snapshot, error) {
+	header, objects, err := ParsePerformanceData(buffer, counterNames, helpNames)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Snapshot{*header, objects}, nil
+}
+
+// Return the object with the given name index, or nil if the snapshot doesn't contain it.
+func (s *Snapshot) Object(nameIndex uint) *PerfObject {
+	for _, object := range s.Objects {
+		if object.NameIndex == nameIndex {
+			return object
+		}
+	}
+
+	return nil
+}
+
+// Time elapsed between an earlier snapshot and this one, measured using the
+// high-resolution performance counter (PerfTime/PerfFreq). Both snapshots need
+// to come from the same machine.
+func (s *Snapshot) Since(prev *Snapshot) time.Duration {
+	if s.PerfFreq == 0 {
+		return 0
+	}
+
+	ticks := s.PerfTime - prev.PerfTime
+
+	// Split into seconds and remainder to avoid overflowing int64 for large tick counts
+	seconds := ticks / s.PerfFreq
+	remainder := ticks % s.PerfFreq
+
+	return time.Duration(seconds)*time.Second + time.Duration(remainder)*time.Second/time.Duration(s.PerfFreq)
+}
@@ -0,0 +1,39 @@
+package perflib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/leoluk/perflib_exporter/perflib/perflibtest"
+)
+
+func TestSnapshot(t *testing.T) {
+	b := perflibtest.New()
+
+	system := b.AddObject(2)
+	system.AddCounter(10, 0x00010000, 4)
+	system.SetValues(42)
+
+	prev, err := ParseSnapshot(b.Bytes(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 1.5 seconds later at 10 MHz
+	b.PerfTime += 15000000
+
+	cur, err := ParseSnapshot(b.Bytes(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cur.SystemName != "TESTHOST" {
+		t.Errorf("unexpected system name %q", cur.SystemName)
+	}
+	if d := cur.Since(prev); d != 1500*time.Millisecond {
+		t.Errorf("expected 1.5s elapsed, got %v", d)
+	}
+	if cur.Object(2) == nil || cur.Object(3) != nil {
+		t.Error("Object returned the wrong objects")
+	}
+}
@@ -0,0 +1,112 @@
+package perflib
+
+import (
+	"fmt"
+	"sync"
+)
+
+// A Source returns performance data for a query (see QueryPerformanceData for
+// the query syntax). It decouples consumers like the collector from the registry,
+// so they can be run off captures or fake data.
+type Source interface {
+	Query(query string) (*Snapshot, error)
+}
+
+// Queries HKEY_PERFORMANCE_DATA. Names are resolved as specified by Options,
+// which may be nil (see QueryWithOptions).
+type RegistrySource struct {
+	Options *Options
+}
+
+func (s RegistrySource) Query(query string) (*Snapshot, error) {
+	return QueryWithOptions(query, s.Options)
+}
+
+// Replays a capture. All queries return the captured data, regardless of the
+// query string, resolved using the captured name tables.
+type CaptureSource struct {
+	capture      *Capture
+	counterNames *NameTable
+	helpNames    *NameTable
+}
+
+func NewCaptureSource(c *Capture) (*CaptureSource, error) {
+	counterNames, helpNames, err := c.NameTables()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &CaptureSource{
+		capture:      c,
+		counterNames: counterNames,
+		helpNames:    helpNames,
+	}, nil
+}
+
+// Like NewCaptureSource, but reads the capture from a file.
+func NewCaptureFileSource(path string) (*CaptureSource, error) {
+	c, err := ReadCaptureFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewCaptureSource(c)
+}
+
+func (s *CaptureSource) Capture() *Capture {
+	return s.capture
+}
+
+// The captured name tables.
+func (s *CaptureSource) NameTables() (counterNames, helpNames *NameTable, err error) {
+	return s.counterNames, s.helpNames, nil
+}
+
+func (s *CaptureSource) Query(query string) (*Snapshot, error) {
+	return ParseSnapshot(s.capture.Data, s.counterNames, s.helpNames)
+}
+
+/*
+In-memory source for tests. Queries are answered from Snapshots, falling back
+to the entry for "" if there's none for the exact query string. If Err is set,
+it is returned for every query.
+
+It is safe for concurrent use, as long as the fields aren't modified.
+*/
+type FakeSource struct {
+	Snapshots map[string]*Snapshot
+	Err       error
+
+	mu      sync.Mutex
+	queries []string
+}
+
+func (s *FakeSource) Query(query string) (*Snapshot, error) {
+	s.mu.Lock()
+	s.queries = append(s.queries, query)
+	s.mu.Unlock()
+
+	if s.Err != nil {
+		return nil, s.Err
+	}
+
+	if snapshot, ok := s.Snapshots[query]; ok {
+		return snapshot, nil
+	}
+
+	if snapshot, ok := s.Snapshots[""]; ok {
+		return snapshot, nil
+	}
+
+	return nil, fmt.Errorf("perflib: no fake data for query %q", query)
+}
+
+// Queries received so far, in order.
+func (s *FakeSource) Queries() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.queries...)
+}
@@ -1,49 +1,72 @@
 package perflib
 
 import (
-	"io"
 	"encoding/binary"
-	"syscall"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
-// Read an unterminated UTF16 string at a given position, specifying its length
-func readUTF16StringAtPos(r io.ReadSeeker, absPos int64, length uint32) (string, error) {
-	value := make([]uint16, length/2)
-	_, err := r.Seek(absPos, io.SeekStart)
+/*
+Decode a UTF-16 string, stopping at the first null character. Unlike
+utf16ToString, this decodes straight from the buffer, allocating only the
+resulting string.
+*/
+func decodeUTF16(b []byte, order binary.ByteOrder) string {
+	n := len(b) / 2
 
-	if err != nil {
-		return "", err
-	}
+	// Fast path for ASCII, which covers nearly all object and instance names
+	ascii := true
+	end := n
 
-	err = binary.Read(r, bo, value)
+	for i := 0; i < n; i++ {
+		c := order.Uint16(b[i*2:])
 
-	if err != nil {
-		return "", err
-	}
+		if c == 0 {
+			end = i
+			break
+		}
 
-	return syscall.UTF16ToString(value), nil
-}
+		if c >= utf8.RuneSelf {
+			ascii = false
+		}
+	}
 
-// Reads a null-terminated UTF16 string at the current offset
-func readUTF16String(r io.Reader) (string, error) {
-	var err error
+	if end == 0 {
+		return ""
+	}
 
-	b := make([]byte, 2)
-	out := make([]uint16, 0, 100)
+	var sb strings.Builder
 
-	for i := 0; err == nil; i += 2 {
-		_, err = r.Read(b)
+	if ascii {
+		sb.Grow(end)
 
-		if b[0] == 0 && b[1] == 0 {
-			break
+		for i := 0; i < end; i++ {
+			sb.WriteByte(byte(order.Uint16(b[i*2:])))
 		}
 
-		out = append(out, bo.Uint16(b))
+		return sb.String()
 	}
 
-	if err != nil {
-		return "", err
+	sb.Grow(end * 3)
+
+	for i := 0; i < end; i++ {
+		c := rune(order.Uint16(b[i*2:]))
+
+		if utf16.IsSurrogate(c) && i+1 < end {
+			if r := utf16.DecodeRune(c, rune(order.Uint16(b[(i+1)*2:]))); r != utf8.RuneError {
+				sb.WriteRune(r)
+				i++
+				continue
+			}
+		}
+
+		if utf16.IsSurrogate(c) {
+			c = utf8.RuneError
+		}
+
+		sb.WriteRune(c)
 	}
 
-	return syscall.UTF16ToString(out), nil
+	return sb.String()
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"strings"
 
 	"github.com/davecgh/go-spew/spew"
@@ -14,27 +15,87 @@ func main() {
 	spew.Dump()
 	var (
 		args = kingpin.Arg("query",
-			"Perflib query").Required().Strings()
+			"Perflib query (defaults to the captured query when replaying)").Strings()
 		showValues = kingpin.Flag("values",
 			"Show counter values").Short('v').Bool()
 		defsOnly = kingpin.Flag("defs-only",
 			"Show definitions only (no instances) and include Prometheus names").Short('o').Bool()
 		unsorted = kingpin.Flag("unsorted",
 			"Do not sort objects").Short('u').Bool()
+		capturePath = kingpin.Flag("capture",
+			"Record the raw query result to a capture file").Short('w').String()
+		replayPath = kingpin.Flag("replay",
+			"Read data from a capture file instead of the registry").Short('r').String()
 	)
 
 	kingpin.Parse()
 
 	query := strings.Join(*args, " ")
 
-	objects, err := perflib.QueryPerformanceData(query)
+	var source perflib.Source = perflib.RegistrySource{}
 
-	if !*unsorted {
-		perflib.SortObjects(objects)
+	if *replayPath != "" {
+		captureSource, err := perflib.NewCaptureFileSource(*replayPath)
+
+		if err != nil {
+			panic(err)
+		}
+
+		source = captureSource
+
+		if query == "" {
+			query = captureSource.Capture().Query
+		}
+	}
+
+	if query == "" {
+		kingpin.Fatalf("required argument 'query' not provided")
+	}
+
+	var snapshot *perflib.Snapshot
+
+	if *capturePath != "" {
+		capture, err := perflib.CaptureQuery(query)
+
+		if err != nil {
+			panic(err)
+		}
+
+		f, err := os.Create(*capturePath)
+
+		if err != nil {
+			panic(err)
+		}
+
+		_, err = capture.WriteTo(f)
+
+		if err == nil {
+			err = f.Close()
+		}
+
+		if err != nil {
+			panic(err)
+		}
+
+		// Show what was written, rather than querying the registry again
+		snapshot, err = capture.Parse()
+
+		if err != nil {
+			panic(err)
+		}
+	} else {
+		var err error
+		snapshot, err = source.Query(query)
+
+		if err != nil {
+			panic(err)
+		}
 	}
 
-	if err != nil {
-		panic(err)
+	objects := snapshot.Objects
+
+	if !*unsorted {
+		perflib.SortObjects(objects)
 	}
 
 	numCounters := 0
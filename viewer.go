@@ -28,16 +28,34 @@ func queryFromRequest(r *http.Request, defaultVal string) string {
 	return defaultVal
 }
 
+// Returns a template function looking up a name or help text in a localized
+// name table, falling back to the English text if there is none.
+func localizedText(table *perflib.NameTable) func(index uint, english string) string {
+	return func(index uint, english string) string {
+		if text := table.LookupString(uint32(index)); text != "" {
+			return text
+		}
+
+		return english
+	}
+}
+
 func dumpHandler(w http.ResponseWriter, r *http.Request) {
 	query := queryFromRequest(r, "Global")
 
 	// TODO: document params
 
 	tStart := time.Now()
-	objects, err := perflib.QueryPerformanceData(query)
+	snapshot, err := source.Query(query)
 	tEnd := time.Now()
 	queryTime := tEnd.Sub(tStart)
 
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	objects := snapshot.Objects
 	count := 0
 
 	for _, o := range objects {
@@ -60,17 +78,17 @@ func dumpHandler(w http.ResponseWriter, r *http.Request) {
 
 	data.Objects = &objects
 
-	if err != nil {
-		panic(err)
-	}
-
 	t := template.New("dump").Funcs(template.FuncMap{
-		"mangle":     collector.MakePrometheusLabel,
-		"has_labels": collector.HasPromotedLabels,
+		"mangle": collector.MakePrometheusLabel,
+		"has_labels": func(n uint) bool {
+			return len(perflibCollector.PromotedLabels(n)) > 0
+		},
+		"local_name": localizedText(localCounterNames),
+		"local_help": localizedText(localHelpNames),
 		"labels": func(n uint, instance *perflib.PerfInstance) map[string]string {
 			m := make(map[string]string)
-			labels := collector.PromotedLabelsForObject(n)
-			values := collector.PromotedLabelValuesForInstance(n, instance)
+			labels := perflibCollector.PromotedLabels(n)
+			values := perflibCollector.PromotedLabelValues(n, instance)
 
 			for i, v := range labels {
 				m[v] = values[i]
@@ -102,6 +120,9 @@ func dumpHandler(w http.ResponseWriter, r *http.Request) {
 	
 	{{ range .Objects }}
 	<h3 id="{{ .NameIndex }}">[{{ .NameIndex }}] {{ .Name }}</h3>
+	{{ $localName := local_name .NameIndex .Name }}
+	{{ if ne $localName .Name }}<p>{{ $localName }}</p>{{ end }}
+	<p>{{ local_help .HelpTextIndex .HelpText }}</p>
 	
 	<table border="1">
 	    <tr>
@@ -113,29 +134,30 @@ func dumpHandler(w http.ResponseWriter, r *http.Request) {
 	        <th>Value</th>
 	        <th>Help Text</th>
 	    </tr>
+	    {{ if .Instances }}
 	    {{ with index .Instances 0 }}
 	    {{ range .Counters }}
 	    <tr>
 	    	{{ with .Def }}
-	        <td>[{{ .NameIndex  }}] {{ .Name }}</td>
+	        <td>[{{ .NameIndex  }}] {{ .Name }}{{ $localName := local_name .NameIndex .Name }}{{ if ne $localName .Name }}<br>{{ $localName }}{{ end }}</td>
 	        <td>{{ . | mangle }}</td>
 	        <td>0x{{ .CounterType | printf "%x" }}</td>
 	        <td>{{ .IsCounter }}</td>
 	        <td>{{ .IsNanosecondCounter }}</td>
 	        {{ end }}
 	        <td>{{ .Value }}</td>
-	        <td>{{ .Def.HelpText }}</td>
+	        <td>{{ local_help .Def.HelpTextIndex .Def.HelpText }}</td>
 	    </tr>
 	    {{ end }}
 	    {{ end }}
+	    {{ end }}
 	</table>
 	<p></p>
 	
-	{{ $num := len .Instances }}
 	{{ $objIdx := .NameIndex }}
 	{{ $hasLabels := has_labels $objIdx }}
-	{{ if gt $num 1 }}
-	Instances:
+	{{ if .HasInstances }}
+	Instances ({{ len .Instances }}):
 	
 	<ul>
 	    {{ range .Instances }}